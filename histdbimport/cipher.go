@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Opens the database at dsn, every connection runs pragmas when it's opened so they apply to any connection of the pool
+func openConnected(dsn string, pragmas []string) *sql.DB {
+	return sql.OpenDB(connector{hookedDriver(pragmas), dsn})
+}
+
+// Returns a driver running pragmas on every connection it opens
+func hookedDriver(pragmas []string) *sqlite3.SQLiteDriver {
+	return &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		return execPragmas(conn, pragmas)
+	}}
+}
+
+// Opens the SQLCipher database at dsn, every connection is keyed before any statement reads the database,
+// followed by pragmas. The settings the driver applies when connecting (locking mode, synchronous) don't read it
+func openEncrypted(dsn, key string, pragmas []string) (*sql.DB, error) {
+	drv := hookedDriver(append([]string{"PRAGMA key = '" + strings.Replace(key, "'", "''", -1) + "';"}, pragmas...))
+	if err := checkCipher(drv); err != nil {
+		return nil, err
+	}
+	return sql.OpenDB(connector{drv, dsn}), nil
+}
+
+// connects to a database with a driver that isn't registered, to give it a connect hook
+type connector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// Reads the schema of db to find out whether it can be decrypted, before anything else fails with the cryptic
+// "file is not a database" of a wrong key, or of an encrypted database opened without one
+func checkReadable(db *sql.DB, keyed bool) error {
+	var tables int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master;").Scan(&tables)
+	if !isNotADB(err) {
+		return err
+	}
+	if keyed {
+		return errors.New("Unable to decrypt database, the key (-key) is wrong or the database isn't encrypted")
+	}
+	return errors.New("Unable to read database, it isn't SQLite or is encrypted, set its SQLCipher key (-key)")
+}
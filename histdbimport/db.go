@@ -0,0 +1,884 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runs the statements of a transaction, a *sql.Tx or autocommit
+type sqlTx interface {
+	Prepare(query string) (*sql.Stmt, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	Commit() error
+	Rollback() error
+}
+
+// runs statements directly on the database, each one committing on its own;
+// like a *sql.Tx, the statements it prepared are closed by Commit and Rollback
+type autocommit struct {
+	*sql.DB
+	stmts []*sql.Stmt
+}
+
+func (a *autocommit) Prepare(query string) (*sql.Stmt, error) {
+	stmt, err := a.DB.Prepare(query)
+	if err == nil {
+		a.stmts = append(a.stmts, stmt)
+	}
+	return stmt, err
+}
+
+func (a *autocommit) Commit() error {
+	for _, stmt := range a.stmts {
+		stmt.Close()
+	}
+	a.stmts = nil
+	return nil
+}
+
+func (a *autocommit) Rollback() error {
+	return a.Commit()
+}
+
+// how a transaction runs and inserts entries
+type txOptions struct {
+	// how long statements are retried while the database is locked by another connection,
+	// commit can't be retried as the driver rolls back on SQLITE_BUSY, it relies on the busy_timeout pragma instead
+	busyTimeout time.Duration
+	// history rows already present are ignored, relying on the unique index created by ensureHistoryUnique
+	ignoreExisting bool
+	// the source line of entries is stored in the raw column of history, added by ensureRawColumn
+	storeRaw bool
+	// every statement commits on its own instead of running in a transaction
+	autocommit bool
+	// names of the histdb tables
+	tables tableNames
+}
+
+type transaction struct {
+	sqlTx
+	txOptions
+	db          *sql.DB
+	cmdStmt     *sql.Stmt
+	placeStmt   *sql.Stmt
+	cmdIDStmt   *sql.Stmt
+	placeIDStmt *sql.Stmt
+	histStmt    *sql.Stmt
+	existStmt   *sql.Stmt
+	batch       *batchStmts
+	// rowids of the commands and places used by the transaction
+	cmdIDs   map[string]int64
+	placeIDs map[[2]string]int64
+	// the last verify inserted entries, compared with the database after the commit
+	verify int
+	recent []basicEntry
+	// rowid of the last history row inserted by the transaction, 0 if it was ignored. Other writers may insert
+	// rows after it when autocommit
+	lastID int64
+	// statements are logged with their arguments if printSQL, masking commands if redactSQL
+	printSQL, redactSQL bool
+	// SQL of the statements prepared on the transaction
+	queries map[*sql.Stmt]preparedQuery
+	// entries are inserted into the stage table by stageStmt until merged by mergeStaged
+	stage     bool
+	stageStmt *sql.Stmt
+}
+
+// SQL of a prepared statement and which of its arguments are commands
+type preparedQuery struct {
+	query string
+	// reports whether the argument at i is a command, nil if none is
+	argv func(i int) bool
+}
+
+// every argument of the statement is a command
+func everyArg(i int) bool { return true }
+
+// multi-row insert statements for a fixed number of entries
+type batchStmts struct {
+	size     int
+	histStmt *sql.Stmt
+}
+
+func (b *batchStmts) Close() {
+	if b.histStmt != nil {
+		b.histStmt.Close()
+	}
+}
+
+func beginTransaction(ctx context.Context, db *sql.DB, opts txOptions) (txx *transaction, err error) {
+	var tx sqlTx = &autocommit{DB: db}
+	if !opts.autocommit {
+		tx, err = db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	t := &transaction{
+		sqlTx:     tx,
+		txOptions: opts,
+		db:        db,
+		cmdIDs:    map[string]int64{},
+		placeIDs:  map[[2]string]int64{},
+		queries:   map[*sql.Stmt]preparedQuery{},
+	}
+	defer func() {
+		if err != nil {
+			if t.cmdStmt != nil {
+				t.cmdStmt.Close()
+			}
+			if t.placeStmt != nil {
+				t.placeStmt.Close()
+			}
+			if t.cmdIDStmt != nil {
+				t.cmdIDStmt.Close()
+			}
+			if t.placeIDStmt != nil {
+				t.placeIDStmt.Close()
+			}
+			if t.histStmt != nil {
+				t.histStmt.Close()
+			}
+			if t.existStmt != nil {
+				t.existStmt.Close()
+			}
+			t.Rollback()
+		}
+	}()
+
+	/*
+	   insert into commands (argv) values (${cmd});
+	   insert into places   (host, dir) values (${HISTDB_HOST}, ${pwd});
+	   insert into history
+	     (session, command_id, place_id, exit_status, start_time, duration)
+	   select
+	     ${HISTDB_SESSION},
+	     commands.rowid,
+	     places.rowid,
+	     ${retval},
+	     ${started},
+	     ${now} - ${started}
+	   from
+	     commands, places
+	   where
+	     commands.argv = ${cmd} and
+	     places.host = ${HISTDB_HOST} and
+	     places.dir = ${pwd}
+	   ;
+	*/
+	t.cmdStmt, err = t.prepare("INSERT OR IGNORE INTO {commands} (argv) VALUES (?);", everyArg)
+	if err != nil {
+		return nil, err
+	}
+	t.placeStmt, err = t.prepare("INSERT OR IGNORE INTO {places} (host, dir) VALUES (?, ?);", nil)
+	if err != nil {
+		return nil, err
+	}
+	// rowids of commands and places already present, when INSERT OR IGNORE didn't insert them
+	t.cmdIDStmt, err = t.prepare("SELECT rowid FROM {commands} WHERE argv = ?;", everyArg)
+	if err != nil {
+		return nil, err
+	}
+	t.placeIDStmt, err = t.prepare("SELECT rowid FROM {places} WHERE host = ? AND dir = ?;", nil)
+	if err != nil {
+		return nil, err
+	}
+	values := "?, ?, ?, ?, ?, ?"
+	if opts.storeRaw {
+		values += ", ?"
+	}
+	t.histStmt, err = t.prepare(`
+		`+t.historyInsert()+` INTO {history} (`+t.historyColumns()+`) VALUES (`+values+`);
+	`, func(i int) bool { return i == 6 })
+	if err != nil {
+		return nil, err
+	}
+	t.existStmt, err = t.prepare(`
+		SELECT EXISTS (
+			SELECT 1 FROM {history}, {commands}, {places}
+			WHERE {history}.command_id = {commands}.rowid AND {history}.place_id = {places}.rowid
+				AND {history}.start_time = ? AND {commands}.argv = ? AND {places}.host = ? AND {places}.dir = ?
+		);
+	`, func(i int) bool { return i == 1 })
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Commits the entries inserted so far and continues in a new transaction
+func (t *transaction) restart(ctx context.Context) error {
+	// statements prepared on the transaction are closed by the commit
+	err := t.Commit()
+	if err != nil {
+		return err
+	}
+
+	next, err := beginTransaction(ctx, t.db, t.txOptions)
+	if err != nil {
+		return err
+	}
+	next.verify, next.recent = t.verify, t.recent
+	next.printSQL, next.redactSQL = t.printSQL, t.redactSQL
+	*t = *next
+	return nil
+}
+
+// Creates the table recording the checksum of imported history files, used to skip files imported twice
+func ensureFilesTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS histdbimport_files (path text, sha256 text primary key, imported_at int);")
+	return err
+}
+
+// Reports whether a history file with checksum sum was imported
+func (t *transaction) fileImported(ctx context.Context, sum string) (imported bool, err error) {
+	const query = "SELECT EXISTS (SELECT 1 FROM histdbimport_files WHERE sha256 = ?);"
+	t.logSQL(query, nil, sum)
+	err = t.QueryRowContext(ctx, query, sum).Scan(&imported)
+	return imported, err
+}
+
+// Records the checksum of an imported history file, committed along with its entries
+func (t *transaction) recordFile(ctx context.Context, path, sum string) error {
+	const query = "INSERT OR REPLACE INTO histdbimport_files (path, sha256, imported_at) VALUES (?, ?, ?);"
+	args := []interface{}{path, sum, time.Now().Unix()}
+	t.logSQL(query, nil, args...)
+	return t.retry(ctx, func() error {
+		_, err := t.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// Creates the table recording every import run with RecordRuns
+func ensureRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS histdbimport_runs (id integer primary key autoincrement,
+		started_at int, files text, host text, inserted int, version text, tag text);`)
+	return err
+}
+
+// Records an import run, committed along with its entries
+func (t *transaction) recordRun(ctx context.Context, started time.Time, files []string, host string, inserted int64, tag string) error {
+	const query = "INSERT INTO histdbimport_runs (started_at, files, host, inserted, version, tag) VALUES (?, ?, ?, ?, ?, ?);"
+	args := []interface{}{started.Unix(), strings.Join(files, "\n"), host, inserted, toolVersion(), tag}
+	t.logSQL(query, nil, args...)
+	return t.retry(ctx, func() error {
+		_, err := t.ExecContext(ctx, query, args...)
+		return err
+	})
+}
+
+// Returns one more than the largest session in history
+func (t *transaction) nextSession(ctx context.Context) (session int64, err error) {
+	query := t.tables.expand("SELECT coalesce(max(session), 0) + 1 FROM {history};")
+	t.logSQL(query, nil)
+	err = t.QueryRowContext(ctx, query).Scan(&session)
+	return session, err
+}
+
+// Creates the table recording how far each history file was imported, used to resume imports
+func ensureProgressTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS histdbimport_progress (file text primary key, entries int);")
+	return err
+}
+
+// Returns the number of entries of file read by the imports committed so far
+func (t *transaction) progress(ctx context.Context, file string) (entries int64, err error) {
+	const query = "SELECT entries FROM histdbimport_progress WHERE file = ?;"
+	t.logSQL(query, nil, file)
+	err = t.QueryRowContext(ctx, query, file).Scan(&entries)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return entries, err
+}
+
+// Records that entries of file were read, committed along with the entries inserted
+func (t *transaction) saveProgress(ctx context.Context, file string, entries int64) error {
+	const query = "INSERT OR REPLACE INTO histdbimport_progress (file, entries) VALUES (?, ?);"
+	t.logSQL(query, nil, file, entries)
+	return t.retry(ctx, func() error {
+		_, err := t.ExecContext(ctx, query, file, entries)
+		return err
+	})
+}
+
+// Reports whether a history row for entry was already imported
+func (t *transaction) entryExists(ctx context.Context, entry basicEntry) (exists bool, err error) {
+	t.logStmt(t.existStmt, entry.started, entry.cmd, entry.host, entry.dir)
+	err = t.retry(ctx, func() error {
+		return t.existStmt.QueryRowContext(ctx, entry.started, entry.cmd, entry.host, entry.dir).Scan(&exists)
+	})
+	return exists, err
+}
+
+// Prepares query on the transaction with the table names expanded, argv reports which of its arguments are commands
+func (t *transaction) prepare(query string, argv func(i int) bool) (*sql.Stmt, error) {
+	query = t.tables.expand(query)
+	stmt, err := t.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	t.queries[stmt] = preparedQuery{query: query, argv: argv}
+	return stmt, nil
+}
+
+// Logs a prepared statement about to run with args
+func (t *transaction) logStmt(stmt *sql.Stmt, args ...interface{}) {
+	if t.printSQL {
+		q := t.queries[stmt]
+		t.logSQL(q.query, q.argv, args...)
+	}
+}
+
+// Logs query and its arguments if printSQL, commands are masked if redactSQL
+func (t *transaction) logSQL(query string, argv func(i int) bool, args ...interface{}) {
+	if !t.printSQL {
+		return
+	}
+	values := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string:
+			if t.redactSQL && argv != nil && argv(i) {
+				values[i] = "<redacted>"
+			} else {
+				values[i] = strconv.Quote(v)
+			}
+		default:
+			values[i] = fmt.Sprint(v)
+		}
+	}
+	log.Printf("SQL: %s [%s]\n", strings.Join(strings.Fields(query), " "), strings.Join(values, ", "))
+}
+
+// Executes stmt, retrying while the database is locked
+func (t *transaction) exec(ctx context.Context, stmt *sql.Stmt, args ...interface{}) (res sql.Result, err error) {
+	t.logStmt(stmt, args...)
+	err = t.retry(ctx, func() error {
+		res, err = stmt.ExecContext(ctx, args...)
+		return err
+	})
+	return res, err
+}
+
+// Runs fn until it doesn't fail with SQLITE_BUSY, waiting twice as long after each attempt until busyTimeout elapsed
+func (t *transaction) retry(ctx context.Context, fn func() error) error {
+	deadline := time.Now().Add(t.busyTimeout)
+	wait := 10 * time.Millisecond
+	for {
+		err := fn()
+		if !isBusy(err) || time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// Inserts entry, reporting false if its history row was already present and ignored
+func (t *transaction) insertEntry(ctx context.Context, entry basicEntry) (inserted bool, err error) {
+	if t.stage {
+		_, err = t.exec(ctx, t.stageStmt, entry.session, entry.exitStatus, entry.started, entry.duration, entry.cmd, entry.host, entry.dir, t.raw(entry))
+		if err != nil {
+			return false, err
+		}
+		t.remember(entry)
+		return true, nil
+	}
+
+	args, err := t.historyArgs(ctx, nil, entry)
+	if err != nil {
+		return false, err
+	}
+	res, err := t.exec(ctx, t.histStmt, args...)
+	if err != nil {
+		return false, err
+	}
+	if t.ignoreExisting {
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			t.lastID = 0
+			return false, err
+		}
+	}
+	if t.lastID, err = res.LastInsertId(); err != nil {
+		return false, err
+	}
+
+	t.remember(entry)
+	return true, nil
+}
+
+// Appends the values of the history row of entry to args, inserting its command and place unless their rowids are cached
+func (t *transaction) historyArgs(ctx context.Context, args []interface{}, entry basicEntry) (_ []interface{}, err error) {
+	cmdID, ok := t.cmdIDs[entry.cmd]
+	if !ok {
+		cmdID, err = t.insertID(ctx, t.cmdStmt, t.cmdIDStmt, entry.cmd)
+		if err != nil {
+			return nil, err
+		}
+		t.cmdIDs[entry.cmd] = cmdID
+	}
+	place := [2]string{entry.host, entry.dir}
+	placeID, ok := t.placeIDs[place]
+	if !ok {
+		placeID, err = t.insertID(ctx, t.placeStmt, t.placeIDStmt, entry.host, entry.dir)
+		if err != nil {
+			return nil, err
+		}
+		t.placeIDs[place] = placeID
+	}
+	args = append(args, entry.session, cmdID, placeID, entry.exitStatus, entry.started, entry.duration)
+	if t.storeRaw {
+		args = append(args, entry.raw)
+	}
+	return args, nil
+}
+
+// Returns the statement inserting history rows, which ignores rows already present if ignoreExisting
+func (t *transaction) historyInsert() string {
+	if t.ignoreExisting {
+		return "INSERT OR IGNORE"
+	}
+	return "INSERT"
+}
+
+// Returns the columns of history set by the import
+func (t *transaction) historyColumns() string {
+	if t.storeRaw {
+		return "session, command_id, place_id, exit_status, start_time, duration, raw"
+	}
+	return "session, command_id, place_id, exit_status, start_time, duration"
+}
+
+// Returns the raw column value of entry, NULL unless storeRaw
+func (t *transaction) raw(entry basicEntry) interface{} {
+	if t.storeRaw {
+		return entry.raw
+	}
+	return nil
+}
+
+// Returns the raw column of table to select along with historyColumns, nothing unless storeRaw
+func (t *transaction) rawSelect(table string) string {
+	if t.storeRaw {
+		return ", " + table + ".raw"
+	}
+	return ""
+}
+
+// reports whether the argument at i of statements taking entries as
+// (session, exit_status, start_time, duration, argv, host, dir, raw) tuples holds a command
+func entryArgv(i int) bool { return i%8 == 4 || i%8 == 7 }
+
+// largest BatchSize, batch statements take 8 arguments per entry and the SQLite bundled with go-sqlite3 allows
+// up to 32766 (SQLITE_MAX_VARIABLE_NUMBER). An SQLite linked with the libsqlite3 tag may allow less
+const maxBatchSize = 32766 / 8
+
+// Keeps the last inserted entries to verify
+func (t *transaction) remember(entries ...basicEntry) {
+	if t.verify == 0 {
+		return
+	}
+	t.recent = append(t.recent, entries...)
+	if n := len(t.recent) - t.verify; n > 0 {
+		t.recent = t.recent[n:]
+	}
+}
+
+// Inserts a row with insertStmt and returns its rowid, looked up with idStmt if the row already existed
+func (t *transaction) insertID(ctx context.Context, insertStmt, idStmt *sql.Stmt, args ...interface{}) (id int64, err error) {
+	res, err := t.exec(ctx, insertStmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	// LastInsertId is left unchanged when INSERT OR IGNORE ignores the row
+	if n, err := res.RowsAffected(); err == nil && n == 1 {
+		return res.LastInsertId()
+	}
+
+	t.logStmt(idStmt, args...)
+	err = t.retry(ctx, func() error {
+		return idStmt.QueryRowContext(ctx, args...).Scan(&id)
+	})
+	return id, err
+}
+
+// Sets the start time, duration and exit status of the latest history row inserted by the transaction to the ones of entry.
+// Nothing is updated if that row was ignored as already present
+func (t *transaction) updateLast(ctx context.Context, entry basicEntry) error {
+	query := t.tables.expand("UPDATE {history} SET exit_status = ?, start_time = ?, duration = ? WHERE id = ?;")
+	args := []interface{}{entry.exitStatus, entry.started, entry.duration, t.lastID}
+	if t.stage {
+		query = "UPDATE temp.histdbimport_stage SET exit_status = ?, start_time = ?, duration = ? WHERE seq = (SELECT max(seq) FROM temp.histdbimport_stage);"
+		args = args[:3]
+	} else if t.lastID == 0 {
+		return nil
+	}
+	t.logSQL(query, nil, args...)
+	err := t.retry(ctx, func() error {
+		_, err := t.ExecContext(ctx, query, args...)
+		return err
+	})
+	if err == nil && len(t.recent) > 0 {
+		last := &t.recent[len(t.recent)-1]
+		last.exitStatus, last.started, last.duration = entry.exitStatus, entry.started, entry.duration
+	}
+	return err
+}
+
+// Prepares statements inserting size entries at once
+func (t *transaction) prepareBatch(size int) (_ *batchStmts, err error) {
+	b := &batchStmts{size: size}
+	// closes the statements prepared before one failed
+	defer func() {
+		if err != nil {
+			b.Close()
+		}
+	}()
+
+	if t.stage {
+		var rows []string
+		for i := 0; i < size; i++ {
+			rows = append(rows, "(?, ?, ?, ?, ?, ?, ?, ?)")
+		}
+		b.histStmt, err = t.prepare(stageInsert+" VALUES "+strings.Join(rows, ", ")+";", entryArgv)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	// rows take the rowids of commands and places resolved by historyArgs, like histStmt
+	values := "(?, ?, ?, ?, ?, ?)"
+	if t.storeRaw {
+		values = "(?, ?, ?, ?, ?, ?, ?)"
+	}
+	var histRows []string
+	for i := 0; i < size; i++ {
+		histRows = append(histRows, values)
+	}
+	b.histStmt, err = t.prepare(t.historyInsert()+" INTO {history} ("+t.historyColumns()+") VALUES "+strings.Join(histRows, ", ")+";",
+		func(i int) bool { return t.storeRaw && i%7 == 6 })
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Inserts entries, returning how many history rows were inserted as rows already present may be ignored
+func (t *transaction) insertBatch(ctx context.Context, entries []basicEntry) (inserted int64, err error) {
+	// statements are prepared for a fixed number of entries, re-prepare if size differs (e.g. on final flush)
+	if t.batch == nil || t.batch.size != len(entries) {
+		if t.batch != nil {
+			t.batch.Close()
+			delete(t.queries, t.batch.histStmt)
+			t.batch = nil
+		}
+		t.batch, err = t.prepareBatch(len(entries))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var histArgs []interface{}
+	if t.stage {
+		for _, entry := range entries {
+			histArgs = append(histArgs, entry.session, entry.exitStatus, entry.started, entry.duration, entry.cmd, entry.host, entry.dir, t.raw(entry))
+		}
+		_, err = t.exec(ctx, t.batch.histStmt, histArgs...)
+		if err != nil {
+			return 0, err
+		}
+		t.remember(entries...)
+		return int64(len(entries)), nil
+	}
+
+	// commands and places are inserted once per distinct value, the batch only inserts history rows
+	for _, entry := range entries {
+		if histArgs, err = t.historyArgs(ctx, histArgs, entry); err != nil {
+			return 0, err
+		}
+	}
+	res, err := t.exec(ctx, t.batch.histStmt, histArgs...)
+	if err != nil {
+		return 0, err
+	}
+	inserted = int64(len(entries))
+	if t.ignoreExisting {
+		if inserted, err = res.RowsAffected(); err != nil {
+			return 0, err
+		}
+	}
+
+	// rows ignored can't be told apart, only whole batches are verified
+	if inserted == int64(len(entries)) {
+		t.remember(entries...)
+		// rows are inserted in the order of entries
+		if t.lastID, err = res.LastInsertId(); err != nil {
+			return 0, err
+		}
+	} else {
+		t.recent = nil
+		t.lastID = 0
+	}
+	return inserted, nil
+}
+
+// inserts entries into the stage table, followed by their values
+const stageInsert = "INSERT INTO temp.histdbimport_stage (session, exit_status, start_time, duration, argv, host, dir, raw)"
+
+// Creates the temporary table entries are inserted into until mergeStaged, it only exists in the transaction
+func (t *transaction) startStaging(ctx context.Context) (err error) {
+	for _, query := range []string{
+		`CREATE TEMP TABLE histdbimport_stage (seq integer primary key autoincrement, session int,
+			exit_status int, start_time int, duration int, argv text, host text, dir text, raw text);`,
+		"CREATE INDEX temp.histdbimport_stage_entry ON histdbimport_stage (start_time, argv, host, dir);",
+	} {
+		t.logSQL(query, nil)
+		if _, err = t.ExecContext(ctx, query); err != nil {
+			return err
+		}
+	}
+
+	t.stageStmt, err = t.prepare(stageInsert+" VALUES (?, ?, ?, ?, ?, ?, ?, ?);", entryArgv)
+	if err != nil {
+		return err
+	}
+	t.stage = true
+	return nil
+}
+
+// Merges the staged entries into commands, places and history in staging order and drops the stage table,
+// returning how many history rows were inserted. Entries already in history, or staged more than once,
+// are left out if skipExisting.
+func (t *transaction) mergeStaged(ctx context.Context, skipExisting bool) (inserted int64, err error) {
+	var dedup string
+	if skipExisting {
+		dedup = `AND s.seq = (SELECT min(seq) FROM temp.histdbimport_stage d
+				WHERE d.start_time = s.start_time AND d.argv = s.argv AND d.host = s.host AND d.dir = s.dir)
+			AND NOT EXISTS (SELECT 1 FROM {history}
+				WHERE {history}.command_id = {commands}.rowid AND {history}.place_id = {places}.rowid AND {history}.start_time = s.start_time)`
+	}
+	queries := []string{
+		"INSERT OR IGNORE INTO {commands} (argv) SELECT argv FROM temp.histdbimport_stage GROUP BY argv ORDER BY min(seq);",
+		"INSERT OR IGNORE INTO {places} (host, dir) SELECT host, dir FROM temp.histdbimport_stage GROUP BY host, dir ORDER BY min(seq);",
+		t.historyInsert() + ` INTO {history} (` + t.historyColumns() + `)
+			SELECT s.session, {commands}.rowid, {places}.rowid, s.exit_status, s.start_time, s.duration` + t.rawSelect("s") + `
+			FROM temp.histdbimport_stage s, {commands}, {places}
+			WHERE {commands}.argv = s.argv AND {places}.host = s.host AND {places}.dir = s.dir ` + dedup + `
+			ORDER BY s.seq;`,
+	}
+	for i, query := range queries {
+		query = t.tables.expand(query)
+		t.logSQL(query, nil)
+		var res sql.Result
+		err = t.retry(ctx, func() error {
+			res, err = t.ExecContext(ctx, query)
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+		if i == len(queries)-1 {
+			if inserted, err = res.RowsAffected(); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	// rows left out can't be told apart, only complete merges are verified
+	const count = "SELECT count(*) FROM temp.histdbimport_stage;"
+	t.logSQL(count, nil)
+	var staged int64
+	if err = t.QueryRowContext(ctx, count).Scan(&staged); err != nil {
+		return 0, err
+	}
+	if inserted != staged {
+		t.recent = nil
+	}
+
+	const drop = "DROP TABLE temp.histdbimport_stage;"
+	t.logSQL(drop, nil)
+	if _, err = t.ExecContext(ctx, drop); err != nil {
+		return 0, err
+	}
+	t.stage = false
+	return inserted, nil
+}
+
+// Compares the last rows of history with the entries they were inserted from, in insertion order
+func verifyEntries(ctx context.Context, db *sql.DB, tables tableNames, entries []basicEntry, lg logger) error {
+	rows, err := db.QueryContext(ctx, tables.expand(`SELECT session, start_time, duration, argv, exit_status, host, dir FROM {history}
+		JOIN {commands} ON {commands}.id = command_id JOIN {places} ON {places}.id = place_id ORDER BY {history}.id DESC LIMIT ?;`), len(entries))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	mismatches := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		want := entries[i]
+		if !rows.Next() {
+			mismatches += i + 1
+			lg.infof("Verify mismatch: %d entries missing from history\n", i+1)
+			break
+		}
+		var got basicEntry
+		err = rows.Scan(&got.session, &got.started, &got.duration, &got.cmd, &got.exitStatus, &got.host, &got.dir)
+		if err != nil {
+			return err
+		}
+		if got.session != want.session || !sameNumber(got.started, want.started) || !sameNumber(got.duration, want.duration) ||
+			!sameNumber(got.exitStatus, want.exitStatus) || got.cmd != want.cmd || got.host != want.host || got.dir != want.dir {
+			mismatches++
+			lg.infof("Verify mismatch: inserted %s, found %s\n", describeRow(want), describeRow(got))
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if mismatches > 0 {
+		return fmt.Errorf("Verification failed: %d of %d entries differ", mismatches, len(entries))
+	}
+	lg.infof("Verified %d entries\n", len(entries))
+	return nil
+}
+
+// Compares numeric columns by value as SQLite stores "007" as 7, other values as text
+func sameNumber(a, b string) bool {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return x == y
+}
+
+// Formats the columns of a history row
+func describeRow(entry basicEntry) string {
+	return fmt.Sprintf("session=%d start_time=%s duration=%s exit_status=%s host=%s dir=%s argv=%q",
+		entry.session, entry.started, entry.duration, entry.exitStatus, entry.host, entry.dir, entry.cmd)
+}
+
+// valid values of the pragmas exposed in Config
+var (
+	journalModes = []string{"delete", "truncate", "persist", "memory", "wal", "off"}
+	syncModes    = []string{"off", "normal", "full", "extra"}
+)
+
+// Returns the pragmas set in cfg, run by every connection when it's opened
+func (cfg *Config) pragmas() ([]string, error) {
+	var pragmas []string
+	if cfg.JournalMode != "" {
+		if !validPragmaValue(cfg.JournalMode, journalModes) {
+			return nil, errors.New("Invalid journal mode=" + cfg.JournalMode)
+		}
+		pragmas = append(pragmas, "PRAGMA journal_mode = "+cfg.JournalMode+";")
+	}
+	if cfg.Synchronous != "" {
+		if !validPragmaValue(cfg.Synchronous, syncModes) {
+			return nil, errors.New("Invalid synchronous mode=" + cfg.Synchronous)
+		}
+		pragmas = append(pragmas, "PRAGMA synchronous = "+cfg.Synchronous+";")
+	}
+	if cfg.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d;", cfg.CacheSize))
+	}
+	if cfg.BusyTimeout != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d;", cfg.BusyTimeout.Milliseconds()))
+	}
+	return pragmas, nil
+}
+
+func validPragmaValue(value string, valid []string) bool {
+	for _, v := range valid {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that commands and places are deduplicated by unique indexes like histdb creates them,
+// history rows are joined on argv and host/dir so duplicated rows would duplicate history as well
+func checkUniqueIndexes(db *sql.DB, tables tableNames) error {
+	required := []struct {
+		table   string
+		columns []string
+	}{
+		{tables.commands, []string{"argv"}},
+		{tables.places, []string{"host", "dir"}},
+	}
+
+	for _, r := range required {
+		ok, err := hasIndex(db, true, r.table, r.columns...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Missing unique index on %s(%s), database must use the histdb schema (see template.db)",
+				r.table, strings.Join(r.columns, ", "))
+		}
+	}
+
+	return nil
+}
+
+// Reports whether table has an index, unique if required, on exactly the given columns
+func hasIndex(db *sql.DB, unique bool, table string, columns ...string) (bool, error) {
+	indexes, err := queryStrings(db, `SELECT name FROM pragma_index_list(?) WHERE NOT ? OR "unique" = 1;`, table, unique)
+	if err != nil {
+		return false, err
+	}
+
+	for _, index := range indexes {
+		indexColumns, err := queryStrings(db, "SELECT name FROM pragma_index_info(?) ORDER BY seqno;", index)
+		if err != nil {
+			return false, err
+		}
+
+		if strings.Join(indexColumns, ",") == strings.Join(columns, ",") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Runs a query returning a single text column and collects its values
+func queryStrings(db *sql.DB, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
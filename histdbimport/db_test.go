@@ -0,0 +1,198 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Pragmas are run by every connection of the pool, not only the one open when the db was configured
+func TestOpenDBPragmas(t *testing.T) {
+	cfg := testConfig(":memory:")
+	cfg.CacheSize = -1234
+	cfg.BusyTimeout = 4321 * time.Millisecond
+	db, err := cfg.openDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(2)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		var cacheSize, busyTimeout int
+		if err := conn.QueryRowContext(ctx, "PRAGMA cache_size;").Scan(&cacheSize); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.QueryRowContext(ctx, "PRAGMA busy_timeout;").Scan(&busyTimeout); err != nil {
+			t.Fatal(err)
+		}
+		if cacheSize != -1234 || busyTimeout != 4321 {
+			t.Errorf("connection %d: cache_size=%d busy_timeout=%d, want -1234 and 4321", i, cacheSize, busyTimeout)
+		}
+	}
+}
+
+func TestOpenDBInvalidPragma(t *testing.T) {
+	cfg := testConfig(":memory:")
+	cfg.JournalMode = "wal; DROP TABLE history"
+	if db, err := cfg.openDB(); err == nil {
+		db.Close()
+		t.Error("opened with an invalid journal mode")
+	}
+}
+
+// Without a transaction, what was inserted before a failure stays in the database
+func TestImportNoTransaction(t *testing.T) {
+	history := ": 1600000000:0;ls\n: 1600000001:0;make\n: 1600000002:x;bad\n: 1600000003:0;ls\n"
+	for _, size := range []int{1, 2, 500} {
+		t.Run(fmt.Sprintf("batch=%d", size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.Strict = true
+			cfg.NoTransaction = true
+			cfg.BatchSize = size
+			addHistories(t, &cfg, history)
+
+			if _, err := Import(context.Background(), cfg); err == nil {
+				t.Fatal("import of an invalid entry succeeded")
+			}
+			if got, want := commandsOf(queryHistory(t, db)), []string{"ls", "make"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("commands = %q, want %q", got, want)
+			}
+
+			// the same failure rolls everything back in a transaction
+			db, dsn = openTestDB(t)
+			cfg.DatabaseURL = dsn
+			cfg.NoTransaction = false
+			if _, err := Import(context.Background(), cfg); err == nil {
+				t.Fatal("import of an invalid entry succeeded")
+			}
+			if got := queryHistory(t, db); len(got) != 0 {
+				t.Errorf("rows = %v, want none", got)
+			}
+		})
+	}
+}
+
+// Files are recognized by their checksum, whatever their path, until forced
+func TestImportSkipImported(t *testing.T) {
+	db, dsn := openTestDB(t)
+	dir := t.TempDir()
+	history := ": 1600000000:0;ls\n: 1600000001:0;make\n"
+	write := func(name, content string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	imp := func(path string, configure func(cfg *Config)) (Stats, error) {
+		cfg := testConfig(dsn)
+		cfg.Format = "zsh"
+		cfg.SkipImported = true
+		configure(&cfg)
+		cfg.HistoryFiles = []HistorySource{{File: path}}
+		return Import(context.Background(), cfg)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		configure func(cfg *Config)
+		inserted  int64
+		fails     bool
+	}{
+		// the checksum is only recorded by the commit of a successful import
+		{"failed", write("history", history), func(cfg *Config) {
+			cfg.OnEntry = func(entry *Entry) (bool, error) { return false, errors.New("failed") }
+		}, 0, true},
+		{"first", filepath.Join(dir, "history"), func(cfg *Config) {}, 2, false},
+		{"again", filepath.Join(dir, "history"), func(cfg *Config) {}, 0, false},
+		{"copy", write("copy", history), func(cfg *Config) {}, 0, false},
+		{"changed", write("changed", history+": 1600000002:0;git status\n"), func(cfg *Config) {}, 3, false},
+		{"forced", filepath.Join(dir, "copy"), func(cfg *Config) { cfg.SkipImported = false }, 2, false},
+	}
+	for _, test := range tests {
+		stats, err := imp(test.path, test.configure)
+		if test.fails != (err != nil) {
+			t.Fatalf("%s: err = %v", test.name, err)
+		}
+		if stats.Inserted != test.inserted {
+			t.Errorf("%s: inserted %d entries, want %d", test.name, stats.Inserted, test.inserted)
+		}
+	}
+
+	if rows := queryHistory(t, db); len(rows) != 7 {
+		t.Errorf("%d rows, want 7", len(rows))
+	}
+	paths := mustQueryStrings(t, db, "SELECT path FROM histdbimport_files ORDER BY path;")
+	if want := []string{filepath.Join(dir, "changed"), filepath.Join(dir, "history")}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("recorded files = %q, want %q", paths, want)
+	}
+}
+
+// Verification compares the last rows of history with the entries inserted, a trigger rewriting rows is caught
+func TestImportVerify(t *testing.T) {
+	history := ": 1600000000:0;ls\n: 1600000001:0;make\n: 1600000002:1;make test\n"
+	tests := []struct {
+		name    string
+		verify  int
+		unit    string
+		trigger string
+		err     string
+	}{
+		{"last", 1, "", "", ""},
+		{"more than inserted", 10, "", "", ""},
+		{"milliseconds", 10, "ms", "", ""},
+		{"start time", 10, "", "UPDATE history SET start_time = start_time + 1 WHERE id = new.id AND new.duration = 1", "Verification failed: 1 of 3 entries differ"},
+		{"command", 10, "", "UPDATE history SET command_id = (SELECT id FROM commands WHERE argv = 'ls') WHERE id = new.id AND new.duration = 1",
+			"Verification failed: 1 of 3 entries differ"},
+		{"deleted", 10, "", "DELETE FROM history WHERE id = new.id AND new.duration = 1", "Verification failed: 3 of 3 entries differ"},
+		// rows before the last ones aren't checked
+		{"not verified", 1, "", "UPDATE history SET start_time = 0 WHERE id = new.id AND new.duration = 0", ""},
+	}
+	for _, test := range tests {
+		for _, size := range []int{1, 500} {
+			t.Run(fmt.Sprintf("%s batch=%d", test.name, size), func(t *testing.T) {
+				db, dsn := openTestDB(t)
+				if test.trigger != "" {
+					_, err := db.Exec(defaultTables.expand(schema) + "CREATE TRIGGER rewrite AFTER INSERT ON history BEGIN " + test.trigger + "; END;")
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+				cfg := testConfig(dsn)
+				cfg.Format = "zsh"
+				cfg.Verify = test.verify
+				cfg.TimeUnit = test.unit
+				cfg.BatchSize = size
+				addHistories(t, &cfg, history)
+
+				_, err := Import(context.Background(), cfg)
+				if test.err == "" && err != nil {
+					t.Fatal(err)
+				} else if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+					t.Errorf("err = %v, want %s", err, test.err)
+				}
+			})
+		}
+	}
+}
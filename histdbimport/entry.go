@@ -0,0 +1,51 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+// Entry is a parsed history entry passed to Config.OnEntry, with the values of its histdb columns
+type Entry struct {
+	Command string
+	Host    string
+	Dir     string
+	// start time in epoch seconds, the import time for entries without timestamp
+	Started string
+	// duration in seconds
+	Duration   string
+	ExitStatus string
+	// session recorded by the history, 0 if it doesn't record one; a different value set by OnEntry is kept
+	Session int64
+}
+
+// Passes entry to OnEntry, reporting whether it is kept along with the changes made to it. The values set by OnEntry
+// are validated like parsed ones, invalid start times being replaced with timestamp
+func (cfg *Config) onEntry(entry basicEntry, timestamp int64) (basicEntry, bool, error) {
+	if cfg.OnEntry == nil {
+		return entry, true, nil
+	}
+
+	e := Entry{
+		Command:    entry.cmd,
+		Host:       entry.host,
+		Dir:        entry.dir,
+		Started:    entry.started,
+		Duration:   entry.duration,
+		ExitStatus: entry.exitStatus,
+		Session:    entry.session,
+	}
+	keep, err := cfg.OnEntry(&e)
+	if err != nil || !keep {
+		return entry, false, err
+	}
+
+	if e.Started != entry.started {
+		entry.synthesized = false
+	}
+	if e.Session != entry.session {
+		entry.hasSession = true
+	}
+	entry.cmd, entry.host, entry.dir = e.Command, e.Host, e.Dir
+	entry.started, entry.duration, entry.exitStatus, entry.session = e.Started, e.Duration, e.ExitStatus, e.Session
+	entry, err = cfg.validate(entry, timestamp)
+	return entry, err == nil, err
+}
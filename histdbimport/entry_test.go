@@ -0,0 +1,73 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOnEntry(t *testing.T) {
+	history := ": 1600000000:5;make\n: 1600000010:0;git push\n"
+	errHook := errors.New("hook failed")
+	tests := []struct {
+		name    string
+		strict  bool
+		onEntry func(e *Entry) (bool, error)
+		want    []historyRow
+		// error the import fails with
+		err string
+	}{
+		{"rewrite", false, func(e *Entry) (bool, error) {
+			e.Command, e.Dir, e.ExitStatus = strings.ToUpper(e.Command), "/src", "1"
+			return true, nil
+		}, []historyRow{
+			{exitStatus: 1, started: 1600000000, duration: 5, argv: "MAKE", host: "host", dir: "/src"},
+			{exitStatus: 1, started: 1600000010, argv: "GIT PUSH", host: "host", dir: "/src"},
+		}, ""},
+		{"drop", false, func(e *Entry) (bool, error) {
+			return !strings.HasPrefix(e.Command, "git "), nil
+		}, []historyRow{
+			{started: 1600000000, duration: 5, argv: "make", host: "host", dir: "/dir"},
+		}, ""},
+		{"error", false, func(e *Entry) (bool, error) {
+			return true, errHook
+		}, nil, errHook.Error()},
+		// invalid values are replaced like parsed ones, the start time like a missing one
+		{"invalid", false, func(e *Entry) (bool, error) {
+			e.Started, e.Duration, e.ExitStatus = "soon", "-5", "x"
+			return true, nil
+		}, []historyRow{
+			{started: testBaseTime.Unix(), argv: "make", host: "host", dir: "/dir"},
+			{started: testBaseTime.Unix(), argv: "git push", host: "host", dir: "/dir"},
+		}, ""},
+		{"invalid strict", true, func(e *Entry) (bool, error) {
+			e.Duration = "-5"
+			return true, nil
+		}, nil, "Invalid duration=-5"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Strict = test.strict
+			cfg.OnEntry = test.onEntry
+			addHistories(t, &cfg, history)
+			_, err := Import(context.Background(), cfg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err = %v, want %q", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := queryHistory(t, db); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("rows = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
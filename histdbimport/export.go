@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Export writes the history of the database described by cfg to w as zsh extended history ordered by start time,
+// returning the number of entries written
+func Export(ctx context.Context, cfg Config, w io.Writer) (count int64, err error) {
+	// start times stored in TimeUnit are written in seconds
+	scale, ok := timeUnits[cfg.TimeUnit]
+	if !ok && cfg.TimeUnit != "" {
+		return 0, errors.New("Unknown time unit=" + cfg.TimeUnit)
+	}
+	if scale == 0 {
+		scale = 1
+	}
+
+	db, err := cfg.openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	tables, err := cfg.tables()
+	if err != nil {
+		return 0, err
+	}
+
+	err = checkColumns(db, tables)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.QueryContext(ctx, tables.expand(`
+		SELECT {history}.start_time, COALESCE({history}.duration, 0), {commands}.argv
+		FROM {history} JOIN {commands} ON {history}.command_id = {commands}.rowid
+		WHERE {history}.start_time IS NOT NULL
+		ORDER BY {history}.start_time, {history}.rowid;
+	`))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	bw := bufio.NewWriter(w)
+	for rows.Next() {
+		var (
+			started, duration int64
+			cmd               string
+		)
+		if err := rows.Scan(&started, &duration, &cmd); err != nil {
+			return count, err
+		}
+
+		_, err = bw.WriteString(formatZshEntry(started/scale, duration, cmd))
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+
+	return count, bw.Flush()
+}
+
+// Formats an entry as a zsh extended history line, the inverse of readEntry and separators.parseEntry
+func formatZshEntry(started, duration int64, cmd string) string {
+	// multiline cmds end each line with a slash
+	cmd = strings.ReplaceAll(cmd, "\n", "\\\n")
+	return metafy(fmt.Sprintf(": %d:%d;%s\n", started, duration, cmd))
+}
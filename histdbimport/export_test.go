@@ -0,0 +1,39 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// A zsh history imported and exported again is unchanged, whatever the unit of the stored start times
+func TestExportRoundTrip(t *testing.T) {
+	history := ": 1600000000:5;make\n: 1600000010:0;echo a\\\nb\n: 1600000020:2;echo café\n"
+	for _, unit := range []string{"s", "ms"} {
+		t.Run(unit, func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.TimeUnit = unit
+			addHistories(t, &cfg, history)
+			if _, err := Import(context.Background(), cfg); err != nil {
+				t.Fatal(err)
+			}
+			if rows := queryHistory(t, db); unit == "ms" && (len(rows) == 0 || rows[0].started != 1600000000000) {
+				t.Errorf("stored start time = %d, want milliseconds", rows[0].started)
+			}
+
+			var buf bytes.Buffer
+			count, err := Export(context.Background(), cfg, &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 3 || buf.String() != history {
+				t.Errorf("exported %d entries:\n%s\nwant 3:\n%s", count, buf.String(), history)
+			}
+		})
+	}
+}
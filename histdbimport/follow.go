@@ -0,0 +1,297 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// history file followed for appended entries
+type followedFile struct {
+	src  HistorySource
+	path string
+	info os.FileInfo
+	// bytes and lines already imported
+	offset int64
+	lines  int64
+	// format detected when following with the auto format
+	format string
+}
+
+// Follow imports the entries appended to the history files after it is called, like tail -f, until ctx is canceled.
+// Files are checked every interval and the entries appended since the last check are committed together.
+// Files whose size decreases or which are replaced, e.g. by rotation, are read again from the start.
+// Files are followed from their offset in offsets, the Offsets of the Stats of the initial import, or from their size
+// if missing. Tail, Limit, Resume, CommitEvery and Confirm only apply to the initial import and are ignored.
+func Follow(ctx context.Context, cfg Config, interval time.Duration, offsets map[string]int64) error {
+	if cfg.Format == "" {
+		cfg.Format = "zsh"
+	}
+	if interval <= 0 {
+		return errors.New("Invalid follow interval=" + interval.String())
+	}
+	cfg.Tail, cfg.Limit, cfg.CommitEvery, cfg.Resume, cfg.Verify, cfg.Confirm = 0, 0, 0, false, 0, nil
+	lg := logger{cfg.LogLevel}
+
+	var files []*followedFile
+	for _, src := range cfg.sources() {
+		if src.File == "-" {
+			return errors.New("Unable to follow history read from stdin")
+		}
+		if IsRemote(src.File) {
+			return errors.New("Unable to follow remote history " + src.File)
+		}
+		path, err := filepath.Abs(src.File)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if err := checkUncompressed(path); err != nil {
+			return err
+		}
+		offset, ok := offsets[path]
+		if !ok {
+			offset = info.Size()
+		}
+		// line numbers of errors continue those of the entries already in the file
+		lines, err := countRecords(path, offset, cfg.recordSep())
+		if err != nil {
+			return err
+		}
+		files = append(files, &followedFile{src: src, path: path, info: info, offset: offset, lines: lines})
+	}
+
+	var db *sql.DB
+	if !cfg.DryRun {
+		var err error
+		db, err = cfg.openDB()
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		tables, err := cfg.tables()
+		if err != nil {
+			return err
+		}
+		err = checkColumns(db, tables)
+		if err != nil {
+			return err
+		}
+		if cfg.StoreRaw {
+			err = ensureRawColumn(db, tables, cfg.CreateSchema, lg)
+			if err != nil {
+				return err
+			}
+		}
+
+		if cfg.AutoSession {
+			tx, err := beginTransaction(ctx, db, cfg.txOptions())
+			if err != nil {
+				return err
+			}
+			cfg.Session, err = tx.nextSession(ctx)
+			tx.Rollback()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	lg.infof("Following %d history files for new entries\n", len(files))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		for _, f := range files {
+			err := f.importAppended(ctx, cfg, db)
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Imports the complete entries appended to f since the last call in a transaction of their own
+func (f *followedFile) importAppended(ctx context.Context, cfg Config, db *sql.DB) error {
+	info, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		// being rotated, the new file is read from the start once it exists
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lg := logger{cfg.LogLevel}
+	if !os.SameFile(info, f.info) || info.Size() < f.offset {
+		lg.infof("%s was truncated or replaced, reading it from the start\n", f.path)
+		f.offset, f.lines = 0, 0
+	}
+	f.info = info
+	if info.Size() == f.offset {
+		return nil
+	}
+
+	fd, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	if _, err := fd.Seek(f.offset, io.SeekStart); err != nil {
+		return err
+	}
+	appended := make([]byte, info.Size()-f.offset)
+	if _, err := io.ReadFull(fd, appended); err != nil {
+		return err
+	}
+
+	// an entry still being written is read by a later call
+	sep := cfg.recordSep()
+	end := bytes.LastIndexByte(appended, sep)
+	if end < 0 {
+		return nil
+	}
+	appended = appended[:end+1]
+	// compressed files are rewritten rather than appended to
+	if f.offset == 0 && bytes.HasPrefix(appended, gzipMagic) {
+		return errors.New("Unable to follow gzip compressed history " + f.path)
+	}
+
+	if f.src.Host != "" {
+		cfg.Host = f.src.Host
+	}
+	if cfg.Format == "auto" {
+		// detected once there are entries, and again when the file is read from the start
+		if f.format == "" || f.offset == 0 {
+			head := appended
+			if f.offset > 0 {
+				head = make([]byte, sniffSize)
+				n, err := fd.ReadAt(head, 0)
+				if err != nil && err != io.EOF {
+					return err
+				}
+				head = head[:n]
+			}
+			f.format, err = cfg.sniffFormat(head)
+			if err != nil {
+				return fmt.Errorf("%s: %v", f.path, err)
+			}
+			lg.infof("Detected %s format for %s\n", f.format, f.path)
+		}
+		cfg.Format = f.format
+	}
+	// the last line may be continued by one still being written
+	if appended = appended[:completeRecords(appended, sep, continuation(cfg.Format))]; len(appended) == 0 {
+		return nil
+	}
+
+	var tx *transaction
+	if db != nil {
+		tx, err = beginTransaction(ctx, db, cfg.txOptions())
+		if err != nil {
+			return err
+		}
+		tx.printSQL, tx.redactSQL = cfg.PrintSQL, cfg.RedactSQL
+	}
+	cfg.lineOffset = f.lines
+	stats, err := readAndInsert(ctx, cfg, tx, bytes.NewReader(appended), f.path)
+	if tx != nil {
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.offset += int64(len(appended))
+	f.lines += int64(bytes.Count(appended, []byte{sep}))
+	lg.infof("Imported new entries of %s: %s\n", f.path, stats)
+	return nil
+}
+
+// Fails if the history file at path is gzip compressed, it can't be followed
+func checkUncompressed(path string) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	magic := make([]byte, len(gzipMagic))
+	if _, err := io.ReadFull(fd, magic); err == nil && bytes.Equal(magic, gzipMagic) {
+		return errors.New("Unable to follow gzip compressed history " + path)
+	}
+	return nil
+}
+
+// Returns the character continuing lines of entries in format on the next line, 0 if they can't be continued
+func continuation(format string) byte {
+	switch format {
+	case "zsh", "zsh-dir", "zsh-host":
+		return '\\'
+	case "psreadline":
+		return '`'
+	}
+	return 0
+}
+
+// Returns the length of the records of data that are complete, ending with sep without being continued with cont
+// on the next line. Records separated by NUL aren't continued
+func completeRecords(data []byte, sep, cont byte) int {
+	for {
+		end := bytes.LastIndexByte(data, sep)
+		if end < 0 {
+			return 0
+		}
+		line := bytes.TrimSuffix(data[:end], []byte("\r"))
+		if sep != '\n' || cont == 0 || len(line) == 0 || line[len(line)-1] != cont {
+			return end + 1
+		}
+		data = data[:end]
+	}
+}
+
+// Counts the records terminated by sep in the first size bytes of the file at path
+func countRecords(path string, size int64, sep byte) (int64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+
+	var count int64
+	buf := make([]byte, 64*1024)
+	r := io.LimitReader(fd, size)
+	for {
+		n, err := r.Read(buf)
+		count += int64(bytes.Count(buf[:n], []byte{sep}))
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompleteRecords(t *testing.T) {
+	tests := []struct {
+		data string
+		sep  byte
+		cont byte
+		want string
+	}{
+		{"a\nb\n", '\n', '\\', "a\nb\n"},
+		{"a\nb", '\n', '\\', "a\n"},
+		{"b", '\n', '\\', ""},
+		// continued on a line still being written
+		{"a\nb\\\n", '\n', '\\', "a\n"},
+		{"a\nb\\\r\n", '\n', '\\', "a\n"},
+		{"a\\\nb\\\n", '\n', '\\', ""},
+		{"a\\\nb\n", '\n', '\\', "a\\\nb\n"},
+		{"a\nb`\n", '\n', '`', "a\n"},
+		// formats without continued lines, and NUL separated records
+		{"a\nb\\\n", '\n', 0, "a\nb\\\n"},
+		{"a\x00b\\\x00", 0, '\\', "a\x00b\\\x00"},
+	}
+	for _, test := range tests {
+		if got := test.data[:completeRecords([]byte(test.data), test.sep, test.cont)]; got != test.want {
+			t.Errorf("complete records of %q = %q, want %q", test.data, got, test.want)
+		}
+	}
+}
+
+// A zsh entry continued on a line that isn't written yet is imported whole once it is
+func TestFollowContinued(t *testing.T) {
+	db, dsn := openTestDB(t)
+	if err := ensureSchema(db, defaultTables, true); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(dsn)
+	cfg.Format = "zsh"
+	path := filepath.Join(t.TempDir(), "history")
+	if err := ioutil.WriteFile(path, []byte(": 1600000000:0;make\n: 1600000001:0;echo a\\\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &followedFile{path: path, info: info}
+
+	ctx := context.Background()
+	if err := f.importAppended(ctx, cfg, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := commandsOf(queryHistory(t, db)), []string{"make"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.WriteString("b\n"); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	if err := f.importAppended(ctx, cfg, db); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := commandsOf(queryHistory(t, db)), []string{"make", "echo a\nb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestFollowGzip(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(": 1600000000:0;make\n"))
+	gz.Close()
+
+	cfg := testConfig("")
+	cfg.DryRun = true
+	path := filepath.Join(t.TempDir(), "history.gz")
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.HistoryFiles = []HistorySource{{File: path}}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := Follow(ctx, cfg, 10*time.Millisecond, nil); err == nil || !strings.Contains(err.Error(), "gzip") {
+		t.Errorf("err = %v, want gzip history rejected", err)
+	}
+}
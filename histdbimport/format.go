@@ -0,0 +1,659 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+)
+
+// used for exit_status column when the history format doesn't record it
+const retVal = "0"
+
+// representation of a history entry
+type basicEntry struct {
+	started    string //no reason to convert to uint64
+	duration   string
+	cmd        string
+	exitStatus string
+	host       string // empty if the format doesn't record it
+	dir        string // empty if the format doesn't record it
+	session    int64
+	// started was synthesized because the entry has no timestamp
+	synthesized bool
+	// session was recorded by the history, kept instead of Config.Session
+	hasSession bool
+	// cmd contained NUL or control bytes, stripped unless they are skipped
+	invalidBytes bool
+	// cmd was longer than Config.MaxCommandLength, truncated unless it is skipped
+	oversize bool
+	// started later than Config.MaxSkew after the import, clamped to the import time with Config.OnFuture clamp
+	future bool
+	// entry as read from the history, stored with Config.StoreRaw
+	raw string
+}
+
+// matches the "#<epoch>" line bash writes before each command when HISTTIMEFORMAT is set
+var bashTimestamp = regexp.MustCompile(`^#[0-9]+$`)
+
+// Reads the entry, traversing multiple lines if needed
+func readEntry(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
+	return readContinued(s, buf, '\\')
+}
+
+// Reads a PSReadLine entry, multi-line commands end their lines with a backtick
+func readPSReadLineEntry(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
+	return readContinued(s, buf, '`')
+}
+
+// Reads an entry whose lines are continued by ending them with cont
+func readContinued(s *bufio.Scanner, buf *bytes.Buffer, cont byte) (string, bool, error) {
+	// lines are appended to a builder, concatenating strings is quadratic in the number of lines
+	var entry strings.Builder
+	for {
+		if !s.Scan() {
+			// the history ended on a continued line, the entry ends there without the dangling continuation
+			if entry.Len() > 0 {
+				return strings.TrimSuffix(entry.String(), "\n"), true, nil
+			}
+			return "", false, nil
+		}
+
+		line := s.Text()
+		if buf != nil {
+			// write line back to buf to recreate scanner later
+			_, err := fmt.Fprintln(buf, line)
+			if err != nil {
+				return "", false, err
+			}
+		}
+
+		//multiline cmds end with cont
+		if len(line) > 0 && line[len(line)-1] == cont {
+			//trim cont and restore the new line
+			entry.WriteString(line[:len(line)-1])
+			entry.WriteByte('\n')
+			continue
+		}
+		entry.WriteString(line)
+		return entry.String(), true, nil
+	}
+}
+
+// separators of zsh extended history entries, ": <started><meta><duration><field><cmd>"
+type separators struct {
+	field string
+	meta  string
+	// started may be any text formatted with Config.TimeFormat instead of epoch seconds
+	formattedStarted bool
+	// matches the timestamp prefix of entries, set by lookupFormat
+	prefix *regexp.Regexp
+}
+
+// separators written by zsh
+var zshSeparators = separators{field: ";", meta: ":"}
+
+// Returns the zsh separators set in cfg
+func (cfg *Config) separators() separators {
+	seps := zshSeparators
+	if cfg.FieldSep != "" {
+		seps.field = cfg.FieldSep
+	}
+	if cfg.MetaSep != "" {
+		seps.meta = cfg.MetaSep
+	}
+	seps.formattedStarted = cfg.TimeFormat != ""
+	return seps
+}
+
+// Returns the regexp matching "<meta><started><meta><duration><field><cmd>" with optional whitespace around
+// started and duration, the duration may be omitted or followed by more fields. Unless formattedStarted, started must be
+// an epoch so commands like ": not a timestamp; ls" or ": 1 && echo; ls" aren't mistaken for a prefix. Only cmd may span lines.
+func (seps separators) prefixRegexp() *regexp.Regexp {
+	meta, field := regexp.QuoteMeta(seps.meta), regexp.QuoteMeta(seps.field)
+	started := `\d+`
+	if seps.formattedStarted {
+		started = `[^\n]+?`
+	}
+	return regexp.MustCompile(`(?s)^` + meta + `[ \t]*(` + started + `)[ \t]*(?:` + meta + `[ \t]*([^\n]*?)[ \t]*)?` + field + `(.*)$`)
+}
+
+// Parses an entry string into a basicEntry
+func (seps separators) parseEntry(entry string, timestamp int64) (basicEntry, error) {
+	entryInfo := basicEntry{exitStatus: retVal}
+	if seps.prefix == nil {
+		seps.prefix = seps.prefixRegexp()
+	}
+
+	// if entry have timestamp data
+	if data := seps.prefix.FindStringSubmatch(entry); data != nil {
+		// processing histfile with timestamp, some writers omit the duration and others add fields after it
+		if strings.Contains(data[1], seps.meta) {
+			return basicEntry{}, errors.New("Unable to parse timestamp=" + entry[:len(entry)-len(data[3])-len(seps.field)])
+		}
+		entryInfo.started = data[1]
+		entryInfo.duration = strings.TrimSpace(strings.SplitN(data[2], seps.meta, 2)[0])
+		if entryInfo.duration == "" {
+			entryInfo.duration = "0"
+		}
+		entryInfo.cmd = data[3]
+	} else {
+		// processing histfile without timestamp
+		entryInfo.started = fmt.Sprintf("%d", timestamp)
+		entryInfo.duration = "0"
+		entryInfo.cmd = entry
+		entryInfo.synthesized = true
+	}
+
+	return entryInfo, nil
+}
+
+// Parses a zsh entry prefixed with its directory and a tab into a basicEntry
+func (seps separators) parseDirEntry(entry string, timestamp int64) (basicEntry, error) {
+	data := strings.SplitN(entry, "\t", 2)
+	if len(data) != 2 {
+		return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+	}
+
+	entryInfo, err := seps.parseEntry(data[1], timestamp)
+	if err != nil {
+		return basicEntry{}, err
+	}
+	entryInfo.dir = data[0]
+
+	return entryInfo, nil
+}
+
+// Parses a zsh entry prefixed with the host it ran on and a tab into a basicEntry
+func (seps separators) parseHostEntry(entry string, timestamp int64) (basicEntry, error) {
+	data := strings.SplitN(entry, "\t", 2)
+	if len(data) != 2 {
+		return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+	}
+
+	entryInfo, err := seps.parseEntry(data[1], timestamp)
+	if err != nil {
+		return basicEntry{}, err
+	}
+	entryInfo.host = data[0]
+
+	return entryInfo, nil
+}
+
+// Parses a bare command line into a basicEntry
+func parsePlainEntry(entry string, timestamp int64) (basicEntry, error) {
+	return basicEntry{
+		started:     fmt.Sprintf("%d", timestamp),
+		duration:    "0",
+		cmd:         entry,
+		exitStatus:  retVal,
+		synthesized: true,
+	}, nil
+}
+
+// Parses a PSReadLine entry into a basicEntry, the file may start with a byte order mark
+func parsePSReadLineEntry(entry string, timestamp int64) (basicEntry, error) {
+	return parsePlainEntry(strings.TrimPrefix(entry, "\ufeff"), timestamp)
+}
+
+// Reads a bash entry, pairing a "#<epoch>" line with the command following it
+func readBashEntry(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
+	var ok bool
+	entry := ""
+	for {
+		ok = s.Scan()
+		if !ok {
+			break
+		}
+
+		if buf != nil {
+			// write line back to buf to recreate scanner later
+			_, err := fmt.Fprintln(buf, s.Text())
+			if err != nil {
+				return "", false, err
+			}
+		}
+
+		// keep the timestamp line and continue reading the command, a timestamp following another one
+		// replaces it as the command it belonged to is missing
+		if bashTimestamp.MatchString(s.Text()) {
+			entry = s.Text() + "\n"
+			continue
+		}
+
+		entry += s.Text()
+		break
+	}
+	return entry, ok, nil
+}
+
+// Parses a bash entry string into a basicEntry
+func parseBashEntry(entry string, timestamp int64) (basicEntry, error) {
+	entryInfo := basicEntry{
+		started:     fmt.Sprintf("%d", timestamp),
+		duration:    "0",
+		cmd:         entry,
+		exitStatus:  retVal,
+		synthesized: true,
+	}
+
+	// if entry have timestamp data
+	data := strings.SplitN(entry, "\n", 2)
+	if len(data) == 2 && bashTimestamp.MatchString(data[0]) {
+		entryInfo.started = data[0][1:]
+		entryInfo.cmd = data[1]
+		entryInfo.synthesized = false
+	}
+
+	return entryInfo, nil
+}
+
+// Splits fish history into blocks, each starting with a top-level "- cmd:" item
+func scanFishBlocks(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	// look for the next top-level item, skipping the one the current block starts with
+	if i := bytes.Index(data[1:], []byte("\n- ")); i >= 0 {
+		return i + 2, bytes.TrimRight(data[:i+1], "\n"), nil
+	}
+	if atEOF {
+		return len(data), bytes.TrimRight(data, "\n"), nil
+	}
+	return 0, nil, nil
+}
+
+// Reads an entry made of a single token of the scanner, e.g. a fish block or a json line
+func readToken(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
+	if !s.Scan() {
+		return "", false, nil
+	}
+
+	if buf != nil {
+		// write token back to buf to recreate scanner later
+		_, err := fmt.Fprintln(buf, s.Text())
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	return s.Text(), true, nil
+}
+
+// Splits records terminated by NUL, the last record may lack the terminator
+func scanNullTerminated(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Reads a NUL terminated record, which is always a whole entry
+func readNullTerminated(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
+	if !s.Scan() {
+		return "", false, nil
+	}
+
+	if buf != nil {
+		// write record back to buf to recreate scanner later
+		buf.WriteString(s.Text())
+		buf.WriteByte(0)
+	}
+
+	return s.Text(), true, nil
+}
+
+// Parses a fish entry block into a basicEntry
+func parseFishEntry(entry string, timestamp int64) (basicEntry, error) {
+	var (
+		hasCmd    bool
+		entryInfo = basicEntry{
+			started:     fmt.Sprintf("%d", timestamp),
+			duration:    "0",
+			exitStatus:  retVal,
+			synthesized: true,
+		}
+	)
+
+	for _, line := range strings.Split(entry, "\n") {
+		// blocks are split on newlines only, drop the carriage return of CRLF files
+		line = strings.TrimSuffix(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "- cmd: "):
+			hasCmd = true
+			entryInfo.cmd = unescapeFish(strings.TrimPrefix(line, "- cmd: "))
+		case strings.HasPrefix(line, "  when: "):
+			entryInfo.started = strings.TrimSpace(strings.TrimPrefix(line, "  when: "))
+			entryInfo.synthesized = false
+		}
+	}
+
+	if !hasCmd {
+		return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+	}
+
+	return entryInfo, nil
+}
+
+// Restores the newlines, tabs and backslashes fish escapes when writing commands
+func unescapeFish(cmd string) string {
+	var sb strings.Builder
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] == '\\' && i+1 < len(cmd) {
+			switch cmd[i+1] {
+			case 'n':
+				sb.WriteByte('\n')
+				i++
+				continue
+			case 't':
+				sb.WriteByte('\t')
+				i++
+				continue
+			case '\\':
+				sb.WriteByte('\\')
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(cmd[i])
+	}
+	return sb.String()
+}
+
+// history entry written as a json object per line, only cmd is required
+type jsonEntry struct {
+	Cmd *string `json:"cmd"`
+	// epoch seconds, or a string in Config.TimeFormat
+	Started    json.RawMessage `json:"started"`
+	Duration   json.Number     `json:"duration"`
+	Host       string          `json:"host"`
+	Dir        string          `json:"dir"`
+	ExitStatus json.Number     `json:"exit_status"`
+}
+
+// Parses a json entry line into a basicEntry
+func parseJSONEntry(entry string, timestamp int64) (basicEntry, error) {
+	var data jsonEntry
+	if err := json.Unmarshal([]byte(entry), &data); err != nil || data.Cmd == nil {
+		return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+	}
+
+	entryInfo := basicEntry{
+		started:    fmt.Sprintf("%d", timestamp),
+		duration:   "0",
+		cmd:        *data.Cmd,
+		exitStatus: retVal,
+		host:       data.Host,
+		dir:        data.Dir,
+	}
+	if data.Duration != "" {
+		entryInfo.duration = data.Duration.String()
+	}
+	if data.ExitStatus != "" {
+		entryInfo.exitStatus = data.ExitStatus.String()
+	}
+
+	switch started := string(data.Started); {
+	case started == "" || started == "null":
+		entryInfo.synthesized = true
+	case strings.HasPrefix(started, `"`):
+		// formatted time, converted to epoch seconds with TimeFormat
+		if err := json.Unmarshal(data.Started, &entryInfo.started); err != nil {
+			return basicEntry{}, errors.New("Unable to parse timestamp=" + started)
+		}
+	default:
+		if _, err := strconv.ParseInt(started, 10, 64); err != nil {
+			return basicEntry{}, errors.New("Unable to parse timestamp=" + started)
+		}
+		entryInfo.started = started
+	}
+
+	return entryInfo, nil
+}
+
+// Parses a histdb row written as tab separated session, host, dir, exit_status, start_time, duration and argv,
+// argv escapes newlines, tabs and backslashes like fish does, empty columns use the defaults of other formats
+func parseHistdbEntry(entry string, timestamp int64) (basicEntry, error) {
+	data := strings.SplitN(entry, "\t", 7)
+	if len(data) != 7 {
+		return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+	}
+
+	entryInfo := basicEntry{
+		started:     data[4],
+		duration:    data[5],
+		cmd:         unescapeFish(data[6]),
+		exitStatus:  data[3],
+		host:        data[1],
+		dir:         data[2],
+		synthesized: data[4] == "",
+	}
+	if data[0] != "" {
+		session, err := strconv.ParseInt(data[0], 10, 64)
+		if err != nil {
+			return basicEntry{}, errors.New("Unable to parse session=" + data[0])
+		}
+		entryInfo.session, entryInfo.hasSession = session, true
+	}
+	if entryInfo.synthesized {
+		entryInfo.started = fmt.Sprintf("%d", timestamp)
+	}
+	if entryInfo.duration == "" {
+		entryInfo.duration = "0"
+	}
+	if entryInfo.exitStatus == "" {
+		entryInfo.exitStatus = retVal
+	}
+
+	return entryInfo, nil
+}
+
+// reads a raw entry string from the scanner
+type entryReader func(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error)
+
+// parses a raw entry string into a basicEntry
+type entryParser func(entry string, timestamp int64) (basicEntry, error)
+
+// functions used to split, read and parse a history format
+type formatHandler struct {
+	split bufio.SplitFunc
+	read  entryReader
+	parse entryParser
+	// history is written metafied by zsh
+	metafied bool
+	// history has no timestamps, entries always get increasing ones like when preserving order
+	ordered bool
+}
+
+// Returns the handler of a supported history format, zsh formats parse entries using seps
+func lookupFormat(format string, seps separators) (formatHandler, bool) {
+	seps.prefix = seps.prefixRegexp()
+	switch format {
+	case "zsh":
+		return formatHandler{bufio.ScanLines, readEntry, seps.parseEntry, true, false}, true
+	case "zsh-dir":
+		return formatHandler{bufio.ScanLines, readEntry, seps.parseDirEntry, true, false}, true
+	case "zsh-host":
+		return formatHandler{bufio.ScanLines, readEntry, seps.parseHostEntry, true, false}, true
+	case "bash":
+		return formatHandler{bufio.ScanLines, readBashEntry, parseBashEntry, false, false}, true
+	case "fish":
+		return formatHandler{scanFishBlocks, readToken, parseFishEntry, false, false}, true
+	case "plain":
+		return formatHandler{bufio.ScanLines, readToken, parsePlainEntry, false, false}, true
+	case "bash-plain":
+		return formatHandler{bufio.ScanLines, readToken, parsePlainEntry, false, true}, true
+	case "histdb-tsv":
+		return formatHandler{bufio.ScanLines, readToken, parseHistdbEntry, false, false}, true
+	case "psreadline":
+		return formatHandler{bufio.ScanLines, readPSReadLineEntry, parsePSReadLineEntry, false, true}, true
+	case "json":
+		return formatHandler{bufio.ScanLines, readToken, parseJSONEntry, false, false}, true
+	}
+	return formatHandler{}, false
+}
+
+// bytes read from the start of a history to detect its format, and non-empty lines looked at
+const (
+	sniffSize  = 64 << 10
+	sniffLines = 10
+)
+
+// Detects the format of the history read from r from its first lines, see sniffFormat.
+// Returns a reader of the whole history, seekable histories are rewound and others replay the bytes read.
+func (cfg *Config) detectFormat(r io.Reader) (string, io.Reader, error) {
+	sample := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", nil, err
+	}
+	sample = sample[:n]
+
+	format, err := cfg.sniffFormat(sample)
+	if err != nil {
+		return "", nil, err
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(-int64(n), io.SeekCurrent); err == nil {
+			return format, r, nil
+		}
+	}
+	return format, io.MultiReader(bytes.NewReader(sample), r), nil
+}
+
+// Guesses the format of a history from the first lines of sample: zsh if they have extended history timestamps,
+// bash if they have #<epoch> comments, fish if they start with "- cmd: " and zsh otherwise, as zsh histories
+// written without extended history have nothing to tell them apart but still need unmetafying and joining of
+// continued lines. Lines looking like more than one format are ambiguous.
+func (cfg *Config) sniffFormat(sample []byte) (string, error) {
+	seps := cfg.separators()
+	meta, field := regexp.QuoteMeta(seps.meta), regexp.QuoteMeta(seps.field)
+	sniffers := []struct {
+		format string
+		re     *regexp.Regexp
+	}{
+		{"zsh", regexp.MustCompile(`^` + meta + `\s*\d+\s*(?:` + meta + `\s*\d+\s*)?` + field)},
+		{"bash", regexp.MustCompile(`^#\d+\s*$`)},
+		{"fish", regexp.MustCompile(`^- cmd: `)},
+	}
+
+	sep := "\n"
+	if cfg.RecordSep == "nul" {
+		sep = "\x00"
+	}
+	var found []string
+	lines := 0
+	for _, line := range strings.Split(string(sample), sep) {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		for _, sniffer := range sniffers {
+			if sniffer.re.MatchString(line) && !containsString(found, sniffer.format) {
+				found = append(found, sniffer.format)
+			}
+		}
+		if lines++; lines == sniffLines {
+			break
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "zsh", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", errors.New("Ambiguous history format, looks like " + strings.Join(found, " and ") + ", set -format")
+}
+
+// Reports whether list contains s
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// zsh writes bytes in the range 0x83-0xa2 (and NUL) as this marker followed by the byte XOR 32
+const zshMeta = 0x83
+
+// Escapes the bytes zsh metafies when writing $HISTFILE
+func metafy(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == 0 || (c >= zshMeta && c <= 0xa2) {
+			sb.WriteByte(zshMeta)
+			c ^= 32
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// transformer reverting zsh's metafy, restoring the original bytes of $HISTFILE
+type unmetafier struct{ transform.NopResetter }
+
+func (unmetafier) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		c, n := src[nSrc], 1
+		if c == zshMeta {
+			switch {
+			case nSrc+1 < len(src):
+				c, n = src[nSrc+1]^32, 2
+			case !atEOF:
+				// wait for the byte following the marker
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			// a marker at the very end is kept as is
+		}
+		if nDst >= len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = c
+		nDst++
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
+
+// transformer keeping valid UTF-8 and decoding the other bytes as latin-1, for histories mixing both
+type latin1Fallback struct{ transform.NopResetter }
+
+func (latin1Fallback) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		r, n := utf8.DecodeRune(src[nSrc:])
+		if r == utf8.RuneError && n == 1 {
+			if !atEOF && !utf8.FullRune(src[nSrc:]) {
+				// wait for the rest of the sequence
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			r = rune(src[nSrc])
+		}
+		if nDst+utf8.RuneLen(r) > len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += utf8.EncodeRune(dst[nDst:], r)
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
@@ -0,0 +1,566 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"golang.org/x/text/transform"
+)
+
+// commands and how zsh writes them in $HISTFILE
+var metafied = []struct {
+	cmd, written string
+}{
+	{"ls", "ls"},
+	// ą is c4 85, ő is c5 91
+	{"echo ą", "echo \xc4\x83\xa5"},
+	{"cat ő.txt", "cat \xc5\x83\xb1.txt"},
+	// the meta byte itself and the last byte metafied
+	{"\x83\xa2", "\x83\xa3\x83\x82"},
+	{"a\x00b", "a\x83\x20b"},
+}
+
+func TestMetafy(t *testing.T) {
+	for _, test := range metafied {
+		if got := metafy(test.cmd); got != test.written {
+			t.Errorf("metafy(%q) = %q, want %q", test.cmd, got, test.written)
+		}
+	}
+}
+
+func TestUnmetafy(t *testing.T) {
+	for _, test := range metafied {
+		got, _, err := transform.String(unmetafier{}, test.written)
+		if err != nil || got != test.cmd {
+			t.Errorf("unmetafy(%q) = %q, %v, want %q", test.written, got, err, test.cmd)
+		}
+		// the marker and the byte it escapes may be read separately
+		data, err := ioutil.ReadAll(transform.NewReader(iotest.OneByteReader(strings.NewReader(test.written)), unmetafier{}))
+		if err != nil || string(data) != test.cmd {
+			t.Errorf("unmetafy(%q) one byte at a time = %q, %v, want %q", test.written, data, err, test.cmd)
+		}
+	}
+	// a marker ending the history is kept
+	if got, _, _ := transform.String(unmetafier{}, "ls\x83"); got != "ls\x83" {
+		t.Errorf("unmetafy(%q) = %q, want it unchanged", "ls\x83", got)
+	}
+}
+
+func TestImportMetafied(t *testing.T) {
+	cfg := testConfig("")
+	cfg.Format = "zsh"
+	var history strings.Builder
+	var want []string
+	for _, test := range metafied[:3] {
+		history.WriteString(": 1600000000:0;" + test.written + "\n")
+		want = append(want, test.cmd)
+	}
+
+	rows, _ := importHistories(t, cfg, history.String())
+	if got := commandsOf(rows); !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
+
+func TestImportCRLF(t *testing.T) {
+	tests := []struct {
+		format, history string
+		want            []string
+	}{
+		{"zsh", ": 1600000000:0;make\r\n: 1600000001:0;echo a\\\r\nb\r\n: 1600000002:0;ls -la\r\n", []string{"make", "echo a\nb", "ls -la"}},
+		// the last line isn't terminated
+		{"zsh", ": 1600000000:0;make\r\n: 1600000001:0;git log\r", []string{"make", "git log"}},
+		{"bash", "#1600000000\r\nmake\r\n#1600000001\r\ngit log\r\n", []string{"make", "git log"}},
+		{"plain", "make\r\ngit log\r\n", []string{"make", "git log"}},
+		{"fish", "- cmd: make\r\n  when: 1600000000\r\n- cmd: git log\r\n  when: 1600000001\r\n", []string{"make", "git log"}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = test.format
+			rows, _ := importHistories(t, cfg, test.history)
+			if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestImportBash(t *testing.T) {
+	tests := []struct {
+		name, history string
+		want          []string
+		started       []int64
+	}{
+		{"timestamped", "#1600000000\nmake\n#1600000005\ngit log\n", []string{"make", "git log"}, []int64{1600000000, 1600000005}},
+		// start times are synthesized, only increasing if preserving order
+		{"untimed", "make\ngit log\n", []string{"make", "git log"}, []int64{testBaseTime.Unix(), testBaseTime.Unix()}},
+		// the command of the first timestamp is missing
+		{"consecutive timestamps", "#1600000000\n#1600000005\nmake\n#1600000009\ngit log\n", []string{"make", "git log"}, []int64{1600000005, 1600000009}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "bash"
+			rows, _ := importHistories(t, cfg, test.history)
+			if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+			var started []int64
+			for _, row := range rows {
+				started = append(started, row.started)
+			}
+			if !reflect.DeepEqual(started, test.started) {
+				t.Errorf("start times = %v, want %v", started, test.started)
+			}
+		})
+	}
+}
+
+// histdb rows written by the query of the README are imported unchanged
+func TestHistdbTSVRoundTrip(t *testing.T) {
+	history := "3\thost\t/home\t1\t1600000000\t5\techo a\\tb\\nc \\\\n\n" +
+		"4\tother\t/tmp\t0\t1600000010\t0\tprintf '\\\\t'\n"
+	db, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.Format = "histdb-tsv"
+	addHistories(t, &cfg, history)
+	if _, err := Import(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	rows := mustQueryStrings(t, db, `SELECT session || char(9) || host || char(9) || dir || char(9) || exit_status || char(9) ||
+			start_time || char(9) || duration || char(9) || replace(replace(replace(argv, '\', '\\'), char(9), '\t'), char(10), '\n')
+		FROM history JOIN commands ON commands.id = command_id JOIN places ON places.id = place_id ORDER BY history.id;`)
+	if got := strings.Join(rows, "\n") + "\n"; got != history {
+		t.Errorf("exported rows:\n%s\nwant:\n%s", got, history)
+	}
+	if cmds := commandsOf(queryHistory(t, db)); len(cmds) != 2 || cmds[0] != "echo a\tb\nc \\n" {
+		t.Errorf("commands = %q", cmds)
+	}
+}
+
+func TestHistdbTSVExitStatus(t *testing.T) {
+	history := "\thost\t/home\tabc\t1600000000\t0\tmake\n"
+	cfg := testConfig("")
+	cfg.Format = "histdb-tsv"
+	rows, _ := importHistories(t, cfg, history)
+	if len(rows) != 1 || rows[0].exitStatus != 0 {
+		t.Errorf("rows = %+v, want one with exit status 0", rows)
+	}
+
+	db, dsn := openTestDB(t)
+	cfg = testConfig(dsn)
+	cfg.Format = "histdb-tsv"
+	cfg.Strict = true
+	addHistories(t, &cfg, history)
+	if _, err := Import(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "exit status=abc") {
+		t.Errorf("err = %v, want invalid exit status", err)
+	}
+	if rows := queryHistory(t, db); len(rows) != 0 {
+		t.Errorf("imported %d rows with Strict", len(rows))
+	}
+}
+
+func TestParseJSONEntry(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  basicEntry
+		// not a valid entry
+		invalid bool
+	}{
+		{`{"cmd": "make", "started": 1600000000, "duration": 5, "host": "h", "dir": "/src", "exit_status": 2}`,
+			basicEntry{started: "1600000000", duration: "5", cmd: "make", exitStatus: "2", host: "h", dir: "/src"}, false},
+		// missing values get the defaults of other formats
+		{`{"cmd": "make"}`, basicEntry{started: "42", duration: "0", cmd: "make", exitStatus: "0", synthesized: true}, false},
+		{`{"cmd": "make", "started": null, "extra": [1]}`, basicEntry{started: "42", duration: "0", cmd: "make", exitStatus: "0", synthesized: true}, false},
+		{`{"cmd": "echo a\nb", "started": 1600000000}`, basicEntry{started: "1600000000", duration: "0", cmd: "echo a\nb", exitStatus: "0"}, false},
+		{`{"cmd": ""}`, basicEntry{started: "42", duration: "0", exitStatus: "0", synthesized: true}, false},
+		// formatted times are converted with TimeFormat later
+		{`{"cmd": "make", "started": "2020-09-13 12:26:40"}`, basicEntry{started: "2020-09-13 12:26:40", duration: "0", cmd: "make", exitStatus: "0"}, false},
+		{`{"cmd": "make", "started": 1.5}`, basicEntry{}, true},
+		{`{"cmd": "make", "started": true}`, basicEntry{}, true},
+		{`{"cmd": "make"`, basicEntry{}, true},
+		{`make`, basicEntry{}, true},
+		{`{"started": 1600000000}`, basicEntry{}, true},
+		{`{"cmd": null}`, basicEntry{}, true},
+		{`{"cmd": 1}`, basicEntry{}, true},
+	}
+	for _, test := range tests {
+		got, err := parseJSONEntry(test.entry, 42)
+		if test.invalid {
+			if err == nil {
+				t.Errorf("parseJSONEntry(%s) = %+v, want an error", test.entry, got)
+			}
+		} else if err != nil {
+			t.Errorf("parseJSONEntry(%s): %v", test.entry, err)
+		} else if got != test.want {
+			t.Errorf("parseJSONEntry(%s) = %+v, want %+v", test.entry, got, test.want)
+		}
+	}
+}
+
+func TestImportJSON(t *testing.T) {
+	history := `{"cmd": "make", "started": 1600000000, "duration": 5}
+{"cmd": "ls", "started": "2020-09-13 12:26:50"}
+not json
+{"started": 1600000020}
+{"cmd": "git push"}
+`
+	for _, skipErrors := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip-errors=%v", skipErrors), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "json"
+			cfg.TimeFormat = "2006-01-02 15:04:05"
+			cfg.Location = time.UTC
+			cfg.SkipErrors = skipErrors
+			addHistories(t, &cfg, history)
+			stats, err := Import(context.Background(), cfg)
+			if !skipErrors {
+				if err == nil || !strings.Contains(err.Error(), "line 3") {
+					t.Errorf("err = %v, want an error on line 3", err)
+				}
+				if rows := queryHistory(t, db); len(rows) != 0 {
+					t.Errorf("imported %d rows from an invalid history", len(rows))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []historyRow{
+				{0, 0, 1600000000, 5, "make", "host", "/dir"},
+				{0, 0, 1600000010, 0, "ls", "host", "/dir"},
+				{0, 0, testBaseTime.Unix(), 0, "git push", "host", "/dir"},
+			}
+			if got := queryHistory(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("history = %v, want %v", got, want)
+			}
+			if stats.ParseErrors != 2 {
+				t.Errorf("parse errors = %d, want 2", stats.ParseErrors)
+			}
+		})
+	}
+}
+
+func TestImportPSReadLine(t *testing.T) {
+	tests := []struct {
+		name, history string
+		want          []string
+	}{
+		{"plain", "Get-ChildItem\ncd C:\\src\n", []string{"Get-ChildItem", "cd C:\\src"}},
+		// the byte order mark isn't part of the first command
+		{"bom", "\ufeffGet-ChildItem\ncd C:\\src\n", []string{"Get-ChildItem", "cd C:\\src"}},
+		{"crlf", "\ufeffGet-ChildItem\r\ncd C:\\src\r\n", []string{"Get-ChildItem", "cd C:\\src"}},
+		// lines ending with a backtick continue on the next one
+		{"multi-line", "Get-Process |`\nWhere-Object CPU`\n-gt 10\nls\n", []string{"Get-Process |\nWhere-Object CPU\n-gt 10", "ls"}},
+		{"multi-line crlf", "Get-Process |`\r\nSort-Object\r\nls\r\n", []string{"Get-Process |\nSort-Object", "ls"}},
+		{"multi-line at eof", "ls\nGet-Process |`\n", []string{"ls", "Get-Process |"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "psreadline"
+			rows, _ := importHistories(t, cfg, test.history)
+			if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+			// one second apart in history order, the last one a second before the import time
+			for i, row := range rows {
+				if want := testBaseTime.Unix() - int64(len(rows)-i); row.started != want {
+					t.Errorf("start time of %q = %d, want %d", row.argv, row.started, want)
+				}
+			}
+		})
+	}
+}
+
+func TestImportEncoding(t *testing.T) {
+	// latin-1 é, UTF-8 é and bytes invalid in UTF-8
+	history := ": 1600000000:0;echo caf\xe9\n: 1600000001:0;echo café\n: 1600000002:0;echo \xff\xfe\n"
+	tests := []struct {
+		encoding string
+		want     []string
+	}{
+		{"", []string{"echo caf\uFFFD", "echo café", "echo \uFFFD\uFFFD"}},
+		{"utf-8", []string{"echo caf\uFFFD", "echo café", "echo \uFFFD\uFFFD"}},
+		{"latin1", []string{"echo café", "echo cafÃ©", "echo ÿþ"}},
+		{"utf-8-lenient", []string{"echo café", "echo café", "echo ÿþ"}},
+	}
+	for _, test := range tests {
+		t.Run(test.encoding, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "zsh"
+			cfg.Encoding = test.encoding
+			rows, _ := importHistories(t, cfg, history)
+			if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLatin1Fallback(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"café", "café"},
+		{"caf\xe9", "café"},
+		{"\xe9t\xe9 中文", "été 中文"},
+		// truncated UTF-8 sequence at the end
+		{"ab\xe4\xb8", "abä¸"},
+	}
+	for _, test := range tests {
+		got, _, err := transform.String(latin1Fallback{}, test.in)
+		if err != nil || got != test.want {
+			t.Errorf("decode(%q) = %q, %v, want %q", test.in, got, err, test.want)
+		}
+		// multi-byte sequences may be split across reads
+		data, err := ioutil.ReadAll(transform.NewReader(iotest.OneByteReader(strings.NewReader(test.in)), latin1Fallback{}))
+		if err != nil || string(data) != test.want {
+			t.Errorf("decode(%q) one byte at a time = %q, %v, want %q", test.in, data, err, test.want)
+		}
+	}
+}
+
+// zsh entries and what parseEntry makes of them, untimed entries start at 42
+var zshEntries = []struct {
+	entry             string
+	started, duration string
+	cmd               string
+}{
+	{entry: ": 1600000000:5;make", started: "1600000000", duration: "5", cmd: "make"},
+	{entry: "make", started: "42", duration: "0", cmd: "make"},
+	// without duration
+	{entry: ": 1600000000;make", started: "1600000000", duration: "0", cmd: "make"},
+	{entry: ": 1600000000:;make", started: "1600000000", duration: "0", cmd: "make"},
+	// whitespace around the start time and duration
+	{entry: ":1600000000:5;make", started: "1600000000", duration: "5", cmd: "make"},
+	{entry: ":  1600000000:5;make", started: "1600000000", duration: "5", cmd: "make"},
+	{entry: ": 1600000000 : 5 ;make", started: "1600000000", duration: "5", cmd: "make"},
+	{entry: ":\t1600000000:5; make", started: "1600000000", duration: "5", cmd: " make"},
+	// not a prefix, imported as an untimed command
+	{entry: ": : 1600000000:0;ls", started: "42", duration: "0", cmd: ": : 1600000000:0;ls"},
+	// semicolons and colons of the command stay in the command
+	{entry: ": 1600000000:0;echo a;b;c", started: "1600000000", duration: "0", cmd: "echo a;b;c"},
+	{entry: "echo a;b;c", started: "42", duration: "0", cmd: "echo a;b;c"},
+	{entry: ": not a timestamp", started: "42", duration: "0", cmd: ": not a timestamp"},
+	{entry: ": not a timestamp; ls", started: "42", duration: "0", cmd: ": not a timestamp; ls"},
+	// the start time is a number, not anything starting with a digit
+	{entry: ": 1 && echo; x", started: "42", duration: "0", cmd: ": 1 && echo; x"},
+	{entry: ": 16000x0000:5;make", started: "42", duration: "0", cmd: ": 16000x0000:5;make"},
+	{entry: ": 1600000000:0;: not a timestamp", started: "1600000000", duration: "0", cmd: ": not a timestamp"},
+	{entry: ": 1600000000:0;: 1600000001:0;ls", started: "1600000000", duration: "0", cmd: ": 1600000001:0;ls"},
+	{entry: ": 1600000000:0;a=1; b=2:3", started: "1600000000", duration: "0", cmd: "a=1; b=2:3"},
+	// the start time and duration don't span lines
+	{entry: ": 1\n:0;ls", started: "42", duration: "0", cmd: ": 1\n:0;ls"},
+	{entry: ": 1600000000:0;echo a\n: 2:0;b", started: "1600000000", duration: "0", cmd: "echo a\n: 2:0;b"},
+	// fields after the duration are ignored
+	{entry: ": 1600000000:0:42;make", started: "1600000000", duration: "0", cmd: "make"},
+	{entry: ": 1600000000:7:42:1234;make", started: "1600000000", duration: "7", cmd: "make"},
+	{entry: ": 1600000000 : 7 : 42 ;make", started: "1600000000", duration: "7", cmd: "make"},
+	{entry: ": 1600000000:7:;make", started: "1600000000", duration: "7", cmd: "make"},
+	{entry: ": 1600000000::42;make", started: "1600000000", duration: "0", cmd: "make"},
+}
+
+func TestParseEntry(t *testing.T) {
+	for _, test := range zshEntries {
+		got, err := zshSeparators.parseEntry(test.entry, 42)
+		if err != nil {
+			t.Errorf("parseEntry(%q) failed: %v", test.entry, err)
+			continue
+		}
+		if got.started != test.started || got.duration != test.duration || got.cmd != test.cmd {
+			t.Errorf("parseEntry(%q) = started %q, duration %q, cmd %q, want %q, %q, %q",
+				test.entry, got.started, got.duration, got.cmd, test.started, test.duration, test.cmd)
+		}
+		if got.synthesized != (test.started == "42") {
+			t.Errorf("parseEntry(%q) synthesized = %v", test.entry, got.synthesized)
+		}
+	}
+}
+
+func TestImportWithoutDuration(t *testing.T) {
+	cfg := testConfig("")
+	cfg.Format = "zsh"
+	rows, _ := importHistories(t, cfg, ": 1600000000:5;make\n: 1600000010;make test\n")
+	want := []historyRow{
+		{0, 0, 1600000000, 5, "make", "host", "/dir"},
+		{0, 0, 1600000010, 0, "make test", "host", "/dir"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("history = %v, want %v", rows, want)
+	}
+}
+
+func TestImportNulRecordSep(t *testing.T) {
+	tests := []struct {
+		format, history string
+		want            []string
+	}{
+		// records may hold newlines, and a trailing backslash doesn't continue them
+		{"zsh", ": 1600000000:0;echo a\\\x00: 1600000001:0;for f in *\ndo echo $f\ndone\x00: 1600000002:0;make\x00", []string{"echo a\\", "for f in *\ndo echo $f\ndone", "make"}},
+		{"plain", "make\x00git commit -m 'a\nb'\x00\x00ls -la", []string{"make", "git commit -m 'a\nb'", "ls -la"}},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = test.format
+			cfg.RecordSep = "nul"
+			rows, _ := importHistories(t, cfg, test.history)
+			if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// Returns the entries read from history by read
+func readEntries(t *testing.T, history string, read func(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error)) []string {
+	t.Helper()
+	s := bufio.NewScanner(strings.NewReader(history))
+	var entries []string
+	for {
+		entry, ok, err := read(s, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return entries
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func TestReadEntryAtEOF(t *testing.T) {
+	tests := []struct {
+		history string
+		want    []string
+	}{
+		{"a\nfoo", []string{"a", "foo"}},
+		{"a\nfoo\n", []string{"a", "foo"}},
+		// the last line is continued, without or with a newline
+		{"a\nfoo\\", []string{"a", "foo"}},
+		{"a\nfoo\\\n", []string{"a", "foo"}},
+		{"a\nfoo\\\nbar\\", []string{"a", "foo\nbar"}},
+		{"foo\\\n\\", []string{"foo\n"}},
+	}
+	for _, test := range tests {
+		if got := readEntries(t, test.history, readEntry); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("entries of %q = %q, want %q", test.history, got, test.want)
+		}
+	}
+	if got, want := readEntries(t, "a\nfoo`", readPSReadLineEntry), []string{"a", "foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PSReadLine entries = %q, want %q", got, want)
+	}
+}
+
+func TestImportContinuedAtEOF(t *testing.T) {
+	history := ": 1600000000:0;make\n: 1600000001:0;echo foo\\"
+	cfg := testConfig("")
+	cfg.Format = "zsh"
+	rows, _ := importHistories(t, cfg, history)
+	if got, want := commandsOf(rows), []string{"make", "echo foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+
+	// the counting pass of Tail sees the last entry as well
+	cfg.Tail = 1
+	rows, _ = importHistories(t, cfg, history)
+	if got, want := commandsOf(rows), []string{"echo foo"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands of the tail = %q, want %q", got, want)
+	}
+}
+
+func TestParseEntrySeparators(t *testing.T) {
+	seps := separators{field: "#", meta: "|"}
+	got, err := seps.parseEntry("| 1600000000|5#make; ls", 42)
+	if err != nil || got.started != "1600000000" || got.duration != "5" || got.cmd != "make; ls" {
+		t.Errorf("parseEntry with | and # = %+v, %v", got, err)
+	}
+	got, err = seps.parseEntry("| 1600000000|5|1|2#make", 42)
+	if err != nil || got.started != "1600000000" || got.duration != "5" || got.cmd != "make" {
+		t.Errorf("parseEntry with | and # and more fields = %+v, %v", got, err)
+	}
+	got, err = seps.parseEntry(": 1600000000:5;make", 42)
+	if err != nil || !got.synthesized || got.cmd != ": 1600000000:5;make" {
+		t.Errorf("parseEntry of a zsh prefix with | and # = %+v, %v, want an untimed command", got, err)
+	}
+}
+
+func TestImportSemicolons(t *testing.T) {
+	cfg := testConfig("")
+	cfg.Format = "zsh"
+	rows, _ := importHistories(t, cfg, ": 1600000000:0;echo a;b;c\n: not a timestamp\n: 1600000001:0;: not a timestamp\\\n; ls\n")
+	want := []historyRow{
+		{0, 0, 1600000000, 0, "echo a;b;c", "host", "/dir"},
+		{0, 0, testBaseTime.Unix(), 0, ": not a timestamp", "host", "/dir"},
+		{0, 0, 1600000001, 0, ": not a timestamp\n; ls", "host", "/dir"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("history = %v, want %v", rows, want)
+	}
+}
+
+// Reads a command continued over 10,000 lines, which took quadratic time when lines were concatenated
+func BenchmarkReadEntryContinued(b *testing.B) {
+	history := ": 1600000000:0;" + strings.Repeat("echo line of a long command\\\n", 9999) + "done\n"
+	b.SetBytes(int64(len(history)))
+	for i := 0; i < b.N; i++ {
+		s := bufio.NewScanner(strings.NewReader(history))
+		entry, ok, err := readEntry(s, nil)
+		if err != nil || !ok || len(entry) != len(history)-1-9999 {
+			b.Fatalf("read %d bytes, %v, %v", len(entry), ok, err)
+		}
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		sample string
+		want   string
+	}{
+		{": 1600000000:0;make\n: 1600000001:0;ls\n", "zsh"},
+		{"#1600000000\nmake\n#1600000001\nls\n", "bash"},
+		{"- cmd: make\n  when: 1600000000\n", "fish"},
+		// zsh without extended history, still unmetafied and continued
+		{"make\necho a\\\nb\n", "zsh"},
+		{"", "zsh"},
+		{"\n\n: 1600000000:0;make\n", "zsh"},
+		{": 1600000000:0;make\n#1600000001\nls\n", ""},
+	}
+	for _, test := range tests {
+		cfg := Config{}
+		got, err := cfg.sniffFormat([]byte(test.sample))
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("sniffFormat(%q) = %s, want an ambiguous format", test.sample, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("sniffFormat(%q) = %s, %v, want %s", test.sample, got, err, test.want)
+		}
+	}
+}
+
+func TestImportAutoFormat(t *testing.T) {
+	cfg := testConfig("")
+	cfg.Format = "auto"
+	rows, _ := importHistories(t, cfg, "make\necho \xc4\x83\xa5\\\nb\n")
+	if got, want := commandsOf(rows), []string{"make", "echo ą\nb"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		glob, cmd string
+		match     bool
+	}{
+		{"ls*", "ls", true},
+		{"ls*", "ls -la /tmp", true},
+		// * and ? match / and newlines
+		{"cat *", "cat /etc/hosts", true},
+		{"echo *", "echo a\nb", true},
+		{"cd ?", "cd /", true},
+		{"echo ?b", "echo \nb", true},
+		{"cd ?", "cd ..", false},
+		{"cd ??", "cd ..", true},
+		{"echo ?", "echo é", true},
+		// the whole command must match
+		{"ls", "ls -la", false},
+		{"ls", "sudo ls", false},
+		{"*ls", "sudo ls", true},
+		{"git push", "git push", true},
+		// character classes, negated with !
+		{"vi[mw] *", "vim a", true},
+		{"vi[mw] *", "vix a", false},
+		{"ls -[a-c]", "ls -b", true},
+		{"ls -[!a-c]", "ls -b", false},
+		{"ls -[!a-c]", "ls -l", true},
+		// escaped and regexp metacharacters are literal
+		{`echo \*`, "echo *", true},
+		{`echo \*`, "echo a", false},
+		{`echo \?`, "echo ?", true},
+		{`echo \[a]`, "echo [a]", true},
+		{"a.b", "a.b", true},
+		{"a.b", "axb", false},
+		{"(x)+$", "(x)+$", true},
+		{"x|y", "x", false},
+		{`ends with \`, `ends with \`, true},
+	}
+	for _, test := range tests {
+		re, err := CompileGlob(test.glob)
+		if err != nil {
+			t.Errorf("CompileGlob(%q): %v", test.glob, err)
+			continue
+		}
+		if got := re.MatchString(test.cmd); got != test.match {
+			t.Errorf("glob %q matching %q = %v, want %v", test.glob, test.cmd, got, test.match)
+		}
+	}
+
+	for _, glob := range []string{"ls [a-", "ls [z-a]"} {
+		if _, err := CompileGlob(glob); err == nil {
+			t.Errorf("CompileGlob(%q) compiled, want an error", glob)
+		}
+	}
+}
@@ -0,0 +1,1726 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+// Package histdbimport imports shell history files into a zsh-histdb database.
+package histdbimport
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/mattn/go-sqlite3"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// ErrCanceled is returned by Import when Confirm declines the import
+var ErrCanceled = errors.New("Import canceled")
+
+// DefaultIgnore is the list of commands ignored by the CLI unless overridden
+var DefaultIgnore = []string{
+	"cd",
+	"ls",
+	"top",
+	"htop",
+}
+
+// Config describes a single import
+type Config struct {
+	// location of database file
+	DatabaseFile string
+	// SQLite DSN passed verbatim to the driver instead of DatabaseFile, e.g. "file:history.db?_journal_mode=WAL"
+	DatabaseURL string
+	// SQLCipher key of the database, issued as PRAGMA key on every connection; requires SQLite built with SQLCipher
+	Key string
+	// location of history file, "-" reads from stdin
+	HistoryFile string
+	// more history files imported after HistoryFile in the same transaction
+	HistoryFiles []HistorySource
+	// format of history file (zsh, zsh-dir, zsh-host, bash, bash-plain, fish, psreadline, json, plain, histdb-tsv), zsh if empty.
+	// auto detects zsh, bash or fish from the first lines of each file, reading untimed files as zsh
+	Format string
+	// separator between the entries of history files (newline, nul), newline if empty
+	RecordSep string
+	// separator between the timestamp data and the command of zsh entries, ";" if empty
+	FieldSep string
+	// separator within the timestamp data of zsh entries, ":" if empty
+	MetaSep string
+	// value for host column, unless overridden by the history source
+	Host string
+	// host names replaced on import, unmapped hosts are kept
+	HostMap map[string]string
+	// appended to every host after HostMap, e.g. to tell apart machines sharing a hostname
+	HostSuffix string
+	// value for dir column, used when the format doesn't record the directory of entries
+	Dir string
+	// directory prefixes replaced on import, the longest matching prefix applies
+	DirMap map[string]string
+	// value for session column, first session when splitting sessions
+	Session int64
+	// use one more than the largest session in history instead of Session, dry runs keep Session
+	AutoSession bool
+	// start a new session when consecutive entries are further apart, sessions aren't split if 0
+	SessionGap time.Duration
+	// Go time layout of start times that aren't epoch seconds, only epoch seconds are accepted if empty;
+	// "relative" accepts times relative to BaseTime like "5m ago", "2 hours ago" or "yesterday"
+	TimeFormat string
+	// location start times in TimeFormat are interpreted in, local time if nil
+	Location *time.Location
+	// unit of the stored start_time (s, ms), seconds if empty
+	TimeUnit string
+	// how newlines of multi-line commands are stored (preserve, collapse, escape), preserved if empty
+	Multiline string
+	// encoding of the history files (utf-8, utf-8-lenient, latin1), utf-8 if empty
+	Encoding string
+	// what to do with commands containing NUL or control bytes other than newline and tab (keep, strip, skip, fail),
+	// kept if empty
+	OnInvalidBytes string
+	// longest command imported in characters, unlimited if 0
+	MaxCommandLength int
+	// shortest command imported in characters, surrounding whitespace excluded; shorter ones are ignored, unlimited if 0
+	MinCommandLength int
+	// what to do with commands longer than MaxCommandLength (truncate ending them with "…", skip), truncated if empty
+	OnOversize string
+	// how far in the future of the clock start times may be, e.g. from hosts with a wrong clock, unchecked if 0
+	MaxSkew time.Duration
+	// what to do with entries starting later than MaxSkew from now (keep, skip, clamp to now, fail), kept if empty;
+	// they are counted either way
+	OnFuture string
+	// set missing or zero durations to the time elapsed between the start of the entry and the import
+	ComputeDuration bool
+	// time of the import used for entries without timestamp and computed durations, the current time if zero
+	BaseTime time.Time
+	// only import entries started at or after Since and at or before Until, unbounded if zero
+	Since time.Time
+	Until time.Time
+	// skip entries without timestamp when Since or Until is set
+	ExcludeUntimed bool
+	// goroutines parsing entries ahead of the inserts, entries are parsed while inserting if 0 or 1
+	Parsers int
+	// stop after inserting Limit entries of each history file, unlimited if 0
+	Limit int64
+	// probability of importing each entry, every entry is imported if 0 or 1
+	Sample float64
+	// seed of the sample, random if 0
+	SampleSeed int64
+	// only import the last Tail entries of each history file, all if 0; read the history twice to count entries
+	Tail int64
+	// commands to ignore during import, compared to commands without surrounding whitespace
+	Ignore []string
+	// compare commands to Ignore case-insensitively
+	IgnoreCase bool
+	// ignore empty and whitespace-only commands
+	SkipEmpty bool
+	// commands matching any of these patterns are ignored as well
+	IgnoreRegex []*regexp.Regexp
+	// if either is set, only commands in Only or matching OnlyRegex are imported, Ignore and IgnoreRegex still apply
+	Only      []string
+	OnlyRegex []*regexp.Regexp
+	// rules skipping or setting the exit status of matching commands, the first matching rule applies
+	Rules []Rule
+	// program every command is piped to, run with sh -c, its output replaces the command; an empty output skips the entry
+	TransformCommand string
+	// keep a single TransformCommand process per history file, exchanging NUL terminated commands, instead of one per entry
+	TransformPersistent bool
+	// how long the persistent TransformCommand may take to answer each command before the import fails, 10s if 0
+	TransformTimeout time.Duration
+	// collapse runs of the same command in the same place into their first entry, updated with the time of the last
+	DedupConsecutive bool
+	// skip timed entries whose start time, command, host and dir repeat an earlier entry of the same file
+	DedupWithinFile bool
+	// rewind the timestamp of entries without one so they keep the order of the histfile
+	PreserveOrder bool
+	// number of entries inserted per statement, entries are inserted one by one if <= 1. At most 4095
+	BatchSize int
+	// parse and log entries without opening the database
+	DryRun bool
+	// SQLite journal_mode pragma, unchanged if empty; wal persists in the database file
+	JournalMode string
+	// SQLite synchronous pragma, unchanged if empty; off is faster but the database may corrupt on power loss
+	Synchronous string
+	// SQLite cache_size pragma, in pages or KiB if negative, unchanged if 0
+	CacheSize int
+	// how long to wait for other connections (e.g. the histdb hook) to unlock the database,
+	// the driver default busy_timeout of 5s applies without retries if 0
+	BusyTimeout time.Duration
+	// commit every CommitEvery inserted entries and continue in a new transaction, a single transaction if 0;
+	// on failure only the entries since the last commit are rolled back
+	CommitEvery int64
+	// commit the entries inserted before an error instead of rolling back, interrupts still roll back
+	KeepPartial bool
+	// skip the entries of each history file read by previous imports, as recorded with CommitEvery or Resume
+	Resume bool
+	// skip history files whose checksum was recorded by a previous import and record the checksum of imported files,
+	// stdin and dry runs aren't checked
+	SkipImported bool
+	// names of the histdb tables, for databases keeping them under other names; commands, places and history if empty.
+	// Only letters, digits and underscores are allowed
+	CommandsTable string
+	PlacesTable   string
+	HistoryTable  string
+	// create the histdb schema if the database has none of its tables, and the raw column of history for StoreRaw
+	CreateSchema bool
+	// database whose schema is copied into the database if it has none, e.g. a new file, instead of CreateSchema
+	TemplateDatabase string
+	// create the indexes histdb queries rely on after the import if missing, only warn about them otherwise
+	CreateIndexes bool
+	// after the commit, compare the last Verify inserted rows with the entries they were inserted from
+	Verify int
+	// asked before inserting the entries of each file with their count, the import fails with ErrCanceled
+	// unless it returns true. Entries are counted first as when preserving order
+	Confirm func(file string, entries int64) (bool, error)
+	// fail on start times, durations and exit statuses that aren't integers or negative durations instead of replacing them
+	Strict bool
+	// log and skip entries that fail to parse instead of aborting the import
+	SkipErrors bool
+	// skip entries whose start time, command, host and dir already exist in history
+	SkipExisting bool
+	// store each entry as read from the history in the raw column of history, which must exist unless CreateSchema
+	StoreRaw bool
+	// run every statement on its own instead of in a transaction, entries are committed as they are inserted
+	// and nothing is rolled back on failure; slower but the database isn't locked for the whole import
+	NoTransaction bool
+	// insert entries into a temporary table and merge them into history right before the commit,
+	// entries are compared with history and each other by the merge if SkipExisting; incompatible with CommitEvery,
+	// KeepPartial and Resume
+	Stage bool
+	// create a unique index over the session, command, place and start time of history if missing,
+	// and ignore the rows it already has when inserting; they are counted as existing
+	DedupHistory bool
+	// log progress periodically instead of every entry
+	Progress bool
+	// log the entries per second and the estimated remaining time of each history file every StatsEvery, never if 0
+	StatsEvery time.Duration
+	// record the run in the histdbimport_runs table: when it started, the history files, Host, the entries inserted,
+	// the version of histdbimport and Tag
+	RecordRuns bool
+	// label of the run recorded in histdbimport_runs, setting it records the run even without RecordRuns
+	Tag string
+	// log the SQL run by the import with its arguments, regardless of LogLevel
+	PrintSQL bool
+	// mask commands in the SQL logged by PrintSQL
+	RedactSQL bool
+	// which messages are logged, per-entry messages are only logged at LogDebug
+	LogLevel LogLevel
+	// called with every entry that isn't ignored or out of range before it is inserted, to change or filter it;
+	// entries are skipped as ignored unless it returns true, errors abort the import.
+	// Called twice per entry when preserving order or with Tail, as entries are counted first
+	OnEntry func(entry *Entry) (keep bool, err error)
+
+	// called with every entry a dry run would insert
+	visit func(entry basicEntry)
+	// lines of the history file before the ones read, when following it
+	lineOffset int64
+	// clock future start times are compared to, time.Now if nil
+	now func() time.Time
+}
+
+// HistorySource is a history file and the host its commands ran on
+type HistorySource struct {
+	// location of history file, "-" reads from stdin, ssh://[user@]host/path copies it from another machine with ssh
+	File string
+	// value for host column, Config.Host if empty
+	Host string
+}
+
+// Stats counts what happened to the entries of an import
+type Stats struct {
+	// entries inserted, or that would be inserted on a dry run
+	Inserted int64 `json:"inserted"`
+	// entries skipped by the ignore rules
+	Ignored int64 `json:"ignored"`
+	// entries skipped as outside Since and Until
+	OutOfRange int64 `json:"out_of_range"`
+	// entries skipped as already present in the database
+	Existing int64 `json:"existing"`
+	// entries collapsed into the previous one as consecutive duplicates, or repeating an earlier entry with DedupWithinFile
+	Duplicates int64 `json:"duplicates"`
+	// entries whose command contained NUL or control bytes, stripped or skipped
+	InvalidBytes int64 `json:"invalid_bytes"`
+	// entries whose command was longer than MaxCommandLength, truncated or skipped
+	Oversize int64 `json:"oversize"`
+	// entries starting later than MaxSkew in the future, kept, skipped or clamped
+	Future int64 `json:"future"`
+	// entries that failed to parse
+	ParseErrors int64 `json:"parse_errors"`
+	// earliest and latest start times of the inserted entries in epoch seconds, 0 if none has a timestamp
+	FirstStarted int64 `json:"first_started,omitempty"`
+	LastStarted  int64 `json:"last_started,omitempty"`
+	// bytes read of each local history file by absolute path, entries appended later are left for Follow
+	Offsets map[string]int64 `json:"-"`
+}
+
+func (s *Stats) add(o Stats) {
+	s.Inserted += o.Inserted
+	s.Ignored += o.Ignored
+	s.OutOfRange += o.OutOfRange
+	s.Existing += o.Existing
+	s.Duplicates += o.Duplicates
+	s.InvalidBytes += o.InvalidBytes
+	s.Oversize += o.Oversize
+	s.Future += o.Future
+	s.ParseErrors += o.ParseErrors
+	if o.FirstStarted != 0 && (s.FirstStarted == 0 || o.FirstStarted < s.FirstStarted) {
+		s.FirstStarted = o.FirstStarted
+	}
+	if o.LastStarted > s.LastStarted {
+		s.LastStarted = o.LastStarted
+	}
+	for path, offset := range o.Offsets {
+		if s.Offsets == nil {
+			s.Offsets = make(map[string]int64)
+		}
+		s.Offsets[path] = offset
+	}
+}
+
+// Widens the time range of the inserted entries to entry, unless its timestamp was synthesized
+func (s *Stats) addStarted(entry basicEntry) {
+	started, err := strconv.ParseInt(entry.started, 10, 64)
+	if entry.synthesized || err != nil {
+		return
+	}
+	s.add(Stats{FirstStarted: started, LastStarted: started})
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("inserted=%d ignored=%d out_of_range=%d existing=%d duplicates=%d invalid_bytes=%d oversize=%d future=%d parse_errors=%d",
+		s.Inserted, s.Ignored, s.OutOfRange, s.Existing, s.Duplicates, s.InvalidBytes, s.Oversize, s.Future, s.ParseErrors)
+}
+
+// number of entries between progress reports
+const progressInterval = 1000
+
+// import progress, total is only known when the history is counted first
+type progress struct {
+	log   logger
+	done  int64
+	total int64
+}
+
+func (p *progress) add() {
+	p.done++
+	if p.done%progressInterval == 0 {
+		p.report()
+	}
+}
+
+func (p *progress) report() {
+	if p.total > 0 {
+		p.log.infof("Processed %d/%d entries (%d%%)\n", p.done, p.total, p.done*100/p.total)
+	} else {
+		p.log.infof("Processed %d entries\n", p.done)
+	}
+}
+
+// Import reads the history files described by cfg and inserts their entries into the database in a single transaction,
+// returning what happened to the entries read so far even on error
+func Import(ctx context.Context, cfg Config) (Stats, error) {
+	if cfg.Format == "" {
+		cfg.Format = "zsh"
+	}
+	lg := logger{cfg.LogLevel}
+	started := time.Now()
+
+	sources := cfg.sources()
+
+	if cfg.DryRun {
+		stats, err := readSources(ctx, cfg, nil, sources)
+		if err != nil {
+			return stats, err
+		}
+		lg.infof("Dry run summary: %s\n", stats)
+		cfg.warnFuture(lg, stats)
+		return stats, nil
+	}
+
+	db, err := cfg.openDB()
+	if err != nil {
+		return Stats{}, err
+	}
+	defer db.Close()
+
+	tables, err := cfg.tables()
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if cfg.TemplateDatabase != "" {
+		err = copySchema(db, cfg.TemplateDatabase, lg)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	err = ensureSchema(db, tables, cfg.CreateSchema)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	err = checkColumns(db, tables)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	err = checkUniqueIndexes(db, tables)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	if cfg.StoreRaw {
+		err = ensureRawColumn(db, tables, cfg.CreateSchema, lg)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	if cfg.Stage && (cfg.CommitEvery > 0 || cfg.KeepPartial || cfg.Resume || cfg.NoTransaction) {
+		return Stats{}, errors.New("Staging can't be combined with commit every, keep partial, resume or no transaction")
+	}
+
+	if cfg.CommitEvery > 0 || cfg.Resume {
+		err = ensureProgressTable(db)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	if cfg.SkipImported {
+		err = ensureFilesTable(db)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	if cfg.DedupHistory {
+		err = ensureHistoryUnique(db, tables, lg)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	recordRun := cfg.RecordRuns || cfg.Tag != ""
+	if recordRun {
+		err = ensureRunsTable(db)
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+
+	tx, err := beginTransaction(ctx, db, cfg.txOptions())
+	if err != nil {
+		return Stats{}, err
+	}
+	tx.verify = cfg.Verify
+	tx.printSQL, tx.redactSQL = cfg.PrintSQL, cfg.RedactSQL
+
+	if cfg.Stage {
+		err = tx.startStaging(ctx)
+		if err != nil {
+			tx.Rollback()
+			return Stats{}, err
+		}
+	}
+
+	if cfg.AutoSession {
+		cfg.Session, err = tx.nextSession(ctx)
+		if err != nil {
+			tx.Rollback()
+			return Stats{}, err
+		}
+		lg.infof("Importing into session %d\n", cfg.Session)
+	}
+
+	stats, err := readSources(ctx, cfg, tx, sources)
+	if err != nil {
+		// the transaction is already rolled back if ctx was canceled
+		if cfg.NoTransaction {
+			tx.Rollback()
+			lg.infof("Entries inserted before the error are kept without transaction: %s\n", stats)
+			return stats, err
+		}
+		if cfg.KeepPartial && ctx.Err() == nil && tx.Commit() == nil {
+			lg.infof("Kept partial import: %s\n", stats)
+			return stats, err
+		}
+		tx.Rollback()
+		return stats, err
+	}
+
+	if cfg.Stage {
+		merged, err := tx.mergeStaged(ctx, cfg.SkipExisting)
+		if err != nil {
+			tx.Rollback()
+			return stats, err
+		}
+		stats.Existing += stats.Inserted - merged
+		stats.Inserted = merged
+	}
+
+	if recordRun {
+		var files []string
+		for _, src := range sources {
+			files = append(files, sourceName(src.File))
+		}
+		err = tx.recordRun(ctx, started, files, cfg.Host, stats.Inserted, cfg.Tag)
+		if err != nil {
+			tx.Rollback()
+			return stats, err
+		}
+	}
+
+	lg.infof("Import summary: %s\n", stats)
+	cfg.warnFuture(lg, stats)
+	err = tx.Commit()
+	if err != nil {
+		return stats, err
+	}
+
+	err = checkIndexes(db, tables, cfg.CreateIndexes, lg)
+	if err != nil {
+		return stats, err
+	}
+
+	if cfg.Verify > 0 {
+		return stats, verifyEntries(ctx, db, tables, tx.recent, lg)
+	}
+	return stats, nil
+}
+
+// Warns about the future entries kept by the import, likely from a host with a wrong clock
+func (cfg *Config) warnFuture(lg logger, stats Stats) {
+	if stats.Future > 0 && (cfg.OnFuture == "" || cfg.OnFuture == "keep") {
+		lg.infof("Warning: kept %d entries starting more than %s in the future, skip or clamp them with -on-future\n", stats.Future, cfg.MaxSkew)
+	}
+}
+
+// Returns how the transactions of the import run
+func (cfg *Config) txOptions() txOptions {
+	// invalid names are rejected by Import and Follow before a transaction begins
+	tables, _ := cfg.tables()
+	return txOptions{
+		busyTimeout:    cfg.BusyTimeout,
+		ignoreExisting: cfg.DedupHistory,
+		storeRaw:       cfg.StoreRaw,
+		autocommit:     cfg.NoTransaction,
+		tables:         tables,
+	}
+}
+
+// Opens the database at DatabaseURL or DatabaseFile, only one of them may be set
+func (cfg *Config) openDB() (*sql.DB, error) {
+	if cfg.DatabaseURL != "" && cfg.DatabaseFile != "" {
+		return nil, errors.New("Only one of the database file and URL can be set")
+	}
+	dsn := cfg.DatabaseFile
+	if cfg.DatabaseURL != "" {
+		dsn = cfg.DatabaseURL
+	}
+
+	pragmas, err := cfg.pragmas()
+	if err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	if cfg.Key != "" {
+		db, err = openEncrypted(dsn, cfg.Key, pragmas)
+	} else {
+		db = openConnected(dsn, pragmas)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// a single connection is enough to import, others would wait for its lock
+	db.SetMaxOpenConns(1)
+	if err := checkReadable(db, cfg.Key != ""); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Returns the absolute path of a history file, stdin and remote files are kept as is
+func sourceName(path string) string {
+	if path == "-" || IsRemote(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Lists HistoryFile followed by HistoryFiles
+func (cfg *Config) sources() []HistorySource {
+	sources := cfg.HistoryFiles
+	if cfg.HistoryFile != "" {
+		sources = append([]HistorySource{{File: cfg.HistoryFile}}, sources...)
+	}
+	return sources
+}
+
+// Lists the files under dir whose name matches the glob pattern, sorted by path, every file if pattern is empty.
+// The host of each file is its name without extension when hostFromName is set.
+func DirSources(dir, pattern string, hostFromName bool) (sources []HistorySource, err error) {
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, errors.New("Invalid glob=" + pattern)
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name := info.Name()
+		if pattern != "" {
+			if ok, _ := filepath.Match(pattern, name); !ok {
+				return nil
+			}
+		}
+		src := HistorySource{File: path}
+		if hostFromName {
+			src.Host = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		sources = append(sources, src)
+		return nil
+	})
+	return sources, err
+}
+
+// Reads every history source and inserts their entries using tx
+func readSources(ctx context.Context, cfg Config, tx *transaction, sources []HistorySource) (stats Stats, err error) {
+	for _, src := range sources {
+		srcCfg := cfg
+		if src.Host != "" {
+			srcCfg.Host = src.Host
+		}
+
+		fileStats, err := readFile(ctx, srcCfg, tx, src.File)
+		stats.add(fileStats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// Reads a history file and inserts its entries using tx
+func readFile(ctx context.Context, cfg Config, tx *transaction, path string) (Stats, error) {
+	// remote files are read from a local copy but recorded by their URL
+	local := path
+	if IsRemote(path) {
+		var err error
+		local, err = fetchRemote(ctx, path, logger{cfg.LogLevel})
+		if err != nil {
+			return Stats{}, err
+		}
+		defer os.Remove(local)
+	}
+
+	fd, err := openHistory(local)
+	if err != nil {
+		return Stats{}, err
+	}
+	defer fd.Close()
+
+	// progress is recorded by absolute path so resuming doesn't depend on the working directory
+	path = sourceName(path)
+
+	// only the bytes present when opened are read, Follow imports the ones appended while importing
+	var r io.Reader = fd
+	var offsets map[string]int64
+	if file, ok := fd.(*os.File); ok && !IsRemote(path) {
+		if info, err := file.Stat(); err == nil && info.Mode().IsRegular() {
+			r = io.NewSectionReader(file, 0, info.Size())
+			offsets = map[string]int64{path: info.Size()}
+		}
+	}
+
+	// files are recognized by content so renamed or copied histories aren't imported twice
+	var sum string
+	if cfg.SkipImported && tx != nil && path != "-" {
+		sum, err = fileChecksum(local)
+		if err != nil {
+			return Stats{}, err
+		}
+		imported, err := tx.fileImported(ctx, sum)
+		if err != nil {
+			return Stats{}, err
+		}
+		if imported {
+			logger{cfg.LogLevel}.infof("Warning: skipping %s, a file with the same sha256 was already imported, use -force to import it again\n", path)
+			return Stats{Offsets: offsets}, nil
+		}
+	}
+
+	if cfg.Format == "auto" {
+		cfg.Format, r, err = cfg.detectFormat(r)
+		if err != nil {
+			return Stats{}, fmt.Errorf("%s: %v", path, err)
+		}
+		logger{cfg.LogLevel}.infof("Detected %s format for %s\n", cfg.Format, path)
+	}
+
+	stats, err := readAndInsert(ctx, cfg, tx, r, path)
+	if err == nil && sum != "" {
+		err = tx.recordFile(ctx, path, sum)
+	}
+	if err == nil {
+		stats.Offsets = offsets
+	}
+	return stats, err
+}
+
+// Returns the hex SHA-256 of the file at path, as stored
+func fileChecksum(path string) (string, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Opens the history file, or stdin if path is "-", gzip compressed history is decompressed
+func openHistory(path string) (io.ReadCloser, error) {
+	var fd io.ReadCloser = ioutil.NopCloser(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fd = file
+	}
+
+	br := bufio.NewReader(fd)
+	magic, err := br.Peek(len(gzipMagic))
+	if err == nil && bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		return gzipFile{gz, fd}, nil
+	}
+
+	// keep files seekable so preserving order doesn't buffer them
+	if seeker, ok := fd.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err == nil {
+			return fd, nil
+		}
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{br, fd}, nil
+}
+
+// first bytes of gzip compressed files
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gzip decompressor closing the underlying history file as well
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// Returns the byte terminating the records of history files
+func (cfg *Config) recordSep() byte {
+	if cfg.RecordSep == "nul" {
+		return 0
+	}
+	return '\n'
+}
+
+// Reports whether cmd is too short, matched by the ignore list, patterns or a skip rule, or isn't allowed by Only, the length and list are compared to the trimmed cmd
+func (cfg *Config) ignored(cmd string) bool {
+	// surrounding whitespace and newlines left by multiline parsing don't matter for the ignore list
+	trimmed := strings.TrimSpace(cmd)
+	if cfg.SkipEmpty && trimmed == "" {
+		return true
+	}
+	if cfg.MinCommandLength > 0 && utf8.RuneCountInString(trimmed) < cfg.MinCommandLength {
+		return true
+	}
+	for _, bc := range cfg.Ignore {
+		bc = strings.TrimSpace(bc)
+		if trimmed == bc || (cfg.IgnoreCase && strings.EqualFold(trimmed, bc)) {
+			return true
+		}
+	}
+	for _, re := range cfg.IgnoreRegex {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	if rule := cfg.rule(cmd); rule != nil && rule.Skip {
+		return true
+	}
+	return !cfg.allowed(cmd)
+}
+
+// Reports whether cmd is in the Only list or matches OnlyRegex, every command is allowed if both are empty
+func (cfg *Config) allowed(cmd string) bool {
+	if len(cfg.Only) == 0 && len(cfg.OnlyRegex) == 0 {
+		return true
+	}
+	trimmed := strings.TrimSpace(cmd)
+	for _, c := range cfg.Only {
+		if trimmed == strings.TrimSpace(c) {
+			return true
+		}
+	}
+	for _, re := range cfg.OnlyRegex {
+		if re.MatchString(cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the longest prefix of dir found in DirMap, prefixes only match whole path components
+func (cfg *Config) mapDir(dir string) string {
+	longest, ok := "", false
+	for prefix := range cfg.DirMap {
+		if len(prefix) < len(longest) || (ok && len(prefix) == len(longest) && prefix > longest) {
+			continue
+		}
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if dir == trimmed || strings.HasPrefix(dir, trimmed+"/") {
+			longest, ok = prefix, true
+		}
+	}
+	if !ok {
+		return dir
+	}
+	rest := strings.TrimPrefix(dir, strings.TrimSuffix(longest, "/"))
+	if rest == "/" {
+		rest = ""
+	}
+	if mapped := strings.TrimSuffix(cfg.DirMap[longest], "/") + rest; mapped != "" {
+		return mapped
+	}
+	return "/"
+}
+
+// Reports whether entry started within Since and Until, entries without timestamp are in range unless ExcludeUntimed
+func (cfg *Config) inRange(entry basicEntry) bool {
+	if cfg.Since.IsZero() && cfg.Until.IsZero() {
+		return true
+	}
+
+	started, err := strconv.ParseInt(entry.started, 10, 64)
+	if entry.synthesized || err != nil {
+		return !cfg.ExcludeUntimed
+	}
+
+	t := time.Unix(started, 0)
+	if !cfg.Since.IsZero() && t.Before(cfg.Since) {
+		return false
+	}
+	if !cfg.Until.IsZero() && t.After(cfg.Until) {
+		return false
+	}
+	return true
+}
+
+// Returns the current time of the clock future start times are compared to
+func (cfg *Config) clock() time.Time {
+	if cfg.now != nil {
+		return cfg.now()
+	}
+	return time.Now()
+}
+
+// Wraps the parser of a format with the defaults and conversions applied to every entry, now is the time of the import
+func (cfg *Config) parser(parse entryParser, now int64) entryParser {
+	// future start times are relative to the clock, even when the import time is set with BaseTime
+	latest := cfg.clock().Add(cfg.MaxSkew).Unix()
+	return func(entry string, timestamp int64) (basicEntry, error) {
+		parsed, err := parse(entry, timestamp)
+		if err != nil {
+			return basicEntry{}, err
+		}
+
+		if parsed.host == "" {
+			parsed.host = cfg.Host
+		}
+		if host, ok := cfg.HostMap[parsed.host]; ok {
+			parsed.host = host
+		}
+		parsed.host += cfg.HostSuffix
+		if parsed.dir == "" {
+			parsed.dir = cfg.Dir
+		}
+		parsed.dir = cfg.mapDir(parsed.dir)
+
+		if normalize, ok := multilineModes[cfg.Multiline]; ok {
+			parsed.cmd = normalize(parsed.cmd)
+		}
+
+		if cfg.OnInvalidBytes != "" && cfg.OnInvalidBytes != "keep" && strings.IndexFunc(parsed.cmd, invalidByte) >= 0 {
+			if cfg.OnInvalidBytes == "fail" {
+				return basicEntry{}, fmt.Errorf("Invalid bytes in command=%q", parsed.cmd)
+			}
+			parsed.invalidBytes = true
+			parsed.cmd = strings.Map(func(r rune) rune {
+				if invalidByte(r) {
+					return -1
+				}
+				return r
+			}, parsed.cmd)
+		}
+
+		if cfg.MaxCommandLength > 0 && utf8.RuneCountInString(parsed.cmd) > cfg.MaxCommandLength {
+			parsed.oversize = true
+			if cfg.OnOversize != "skip" {
+				parsed.cmd = truncate(parsed.cmd, cfg.MaxCommandLength)
+			}
+		}
+
+		if rule := cfg.rule(parsed.cmd); rule != nil && !rule.Skip {
+			parsed.exitStatus = strconv.Itoa(rule.ExitStatus)
+		}
+
+		parsed.started, err = cfg.epoch(parsed.started, now)
+		if err != nil {
+			return basicEntry{}, err
+		}
+		parsed, err = cfg.validate(parsed, timestamp)
+		if err != nil {
+			return basicEntry{}, err
+		}
+
+		if cfg.MaxSkew > 0 && !parsed.synthesized {
+			if started, err := strconv.ParseInt(parsed.started, 10, 64); err == nil && started > latest {
+				switch cfg.OnFuture {
+				case "fail":
+					return basicEntry{}, fmt.Errorf("Start time %s is more than %s in the future", parsed.started, cfg.MaxSkew)
+				case "clamp":
+					parsed.started = strconv.FormatInt(cfg.clock().Unix(), 10)
+				}
+				parsed.future = true
+			}
+		}
+
+		// like histdb, duration is the time elapsed since the command started
+		if cfg.ComputeDuration && (parsed.duration == "" || parsed.duration == "0") {
+			if started, err := strconv.ParseInt(parsed.started, 10, 64); err == nil {
+				duration := now - started
+				if duration < 0 {
+					duration = 0
+				}
+				parsed.duration = strconv.FormatInt(duration, 10)
+			}
+		}
+
+		return parsed, nil
+	}
+}
+
+// Replaces invalid start times of entry like missing ones with timestamp, invalid durations and exit statuses by 0,
+// unless Strict
+func (cfg *Config) validate(entry basicEntry, timestamp int64) (basicEntry, error) {
+	if _, err := strconv.ParseInt(entry.started, 10, 64); err != nil {
+		if cfg.Strict {
+			return basicEntry{}, errors.New("Unable to parse timestamp=" + entry.started)
+		}
+		entry.started, entry.synthesized = strconv.FormatInt(timestamp, 10), true
+	}
+	if duration, err := strconv.ParseInt(entry.duration, 10, 64); err != nil || duration < 0 {
+		if cfg.Strict && entry.duration != "" {
+			return basicEntry{}, errors.New("Invalid duration=" + entry.duration)
+		}
+		entry.duration = "0"
+	}
+	if _, err := strconv.ParseInt(entry.exitStatus, 10, 64); err != nil {
+		if cfg.Strict && entry.exitStatus != "" {
+			return basicEntry{}, errors.New("Invalid exit status=" + entry.exitStatus)
+		}
+		entry.exitStatus = retVal
+	}
+	return entry, nil
+}
+
+// Reports whether r is NUL or a control character other than newline and tab
+func invalidByte(r rune) bool {
+	return r < 0x20 && r != '\n' && r != '\t'
+}
+
+// Returns a function drawing whether the next entry is part of the sample, nil if every entry is imported
+func (cfg *Config) sampler() func() bool {
+	if cfg.Sample <= 0 || cfg.Sample >= 1 {
+		return nil
+	}
+	rng := rand.New(rand.NewSource(cfg.SampleSeed))
+	return func() bool {
+		return rng.Float64() < cfg.Sample
+	}
+}
+
+// Shortens cmd to max characters, the last one being an ellipsis
+func truncate(cmd string, max int) string {
+	runes := []rune(cmd)
+	return string(runes[:max-1]) + "…"
+}
+
+// normalizations of the newlines of multi-line commands
+var multilineModes = map[string]func(cmd string) string{
+	"preserve": func(cmd string) string { return cmd },
+	"collapse": func(cmd string) string { return strings.Replace(cmd, "\n", " ", -1) },
+	"escape":   func(cmd string) string { return strings.Replace(cmd, "\n", `\n`, -1) },
+}
+
+// decoders of the history files to UTF-8, invalid UTF-8 is replaced with U+FFFD by utf-8
+var encodings = map[string]func() transform.Transformer{
+	"utf-8":         func() transform.Transformer { return unicode.UTF8.NewDecoder() },
+	"utf-8-lenient": func() transform.Transformer { return latin1Fallback{} },
+	"latin1":        func() transform.Transformer { return charmap.ISO8859_1.NewDecoder() },
+}
+
+// start_time units, as multiples of a second
+var timeUnits = map[string]int64{
+	"s":  1,
+	"ms": 1000,
+}
+
+// Scales the start time of entry from seconds to TimeUnit
+func (cfg *Config) stored(entry basicEntry) basicEntry {
+	if scale := timeUnits[cfg.TimeUnit]; scale > 1 {
+		started, _ := strconv.ParseInt(entry.started, 10, 64)
+		entry.started = strconv.FormatInt(started*scale, 10)
+	}
+	return entry
+}
+
+// Converts a start time formatted with TimeFormat to epoch seconds, numeric values are already epoch seconds,
+// relative times are relative to now
+func (cfg *Config) epoch(started string, now int64) (string, error) {
+	if cfg.TimeFormat == "" {
+		return started, nil
+	}
+	if _, err := strconv.ParseInt(started, 10, 64); err == nil {
+		return started, nil
+	}
+	if cfg.TimeFormat == "relative" {
+		ago, err := parseRelative(started)
+		if err != nil {
+			return "", err
+		}
+		return strconv.FormatInt(now-int64(ago/time.Second), 10), nil
+	}
+
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	t, err := time.ParseInLocation(cfg.TimeFormat, started, loc)
+	if err != nil {
+		return "", errors.New("Unable to parse time=" + started)
+	}
+	return strconv.FormatInt(t.Unix(), 10), nil
+}
+
+// matches relative times like "5m ago" or "2 hours ago"
+var relativeTime = regexp.MustCompile(`^(\d+)\s*([a-z]+)\s+ago$`)
+
+// units of relative times
+var relativeUnits = map[string]time.Duration{
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// Parses a time relative to now ("5m ago", "2 hours ago", "yesterday", "now") into how long ago it was
+func parseRelative(value string) (time.Duration, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	switch value {
+	case "now", "today":
+		return 0, nil
+	case "yesterday":
+		return 24 * time.Hour, nil
+	}
+
+	m := relativeTime.FindStringSubmatch(value)
+	if m == nil {
+		return 0, errors.New("Unable to parse relative time=" + value)
+	}
+	unit, ok := relativeUnits[m[2]]
+	n, err := strconv.ParseInt(m[1], 10, 64)
+	if !ok || err != nil {
+		return 0, errors.New("Unable to parse relative time=" + value)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// Reads entries from r and inserts them using tx, nothing is inserted if tx is nil,
+// progress is recorded under file when committing periodically or resuming
+func readAndInsert(ctx context.Context, cfg Config, tx *transaction, r io.Reader, file string) (stats Stats, err error) {
+	// use currentTimestamp as timestamp for commands if histfile doesn't contain timestamp
+	currentTimestamp := time.Now().Unix()
+	if !cfg.BaseTime.IsZero() {
+		currentTimestamp = cfg.BaseTime.Unix()
+	}
+
+	handler, ok := lookupFormat(cfg.Format, cfg.separators())
+	if !ok {
+		return stats, errors.New("Unknown history format=" + cfg.Format)
+	}
+	switch cfg.RecordSep {
+	case "", "newline":
+	case "nul":
+		// bash pairs timestamp and command lines, fish entries are blocks of lines
+		if cfg.Format == "bash" || cfg.Format == "fish" {
+			return stats, errors.New("NUL record separator isn't supported by format=" + cfg.Format)
+		}
+		// records are whole entries, lines ending with a backslash don't continue them
+		handler.split, handler.read = scanNullTerminated, readNullTerminated
+	default:
+		return stats, errors.New("Unknown record separator=" + cfg.RecordSep)
+	}
+
+	encoding := cfg.Encoding
+	if encoding == "" {
+		encoding = "utf-8"
+	}
+	decoder, ok := encodings[encoding]
+	if !ok {
+		return stats, errors.New("Unknown encoding=" + cfg.Encoding)
+	}
+
+	// lines read so far, to tell where entries start
+	lines := &lineCounter{sep: cfg.recordSep(), lines: cfg.lineOffset}
+	newScanner := func(r io.Reader) *bufio.Scanner {
+		// zsh escapes some bytes, unmetafy before decoding
+		if handler.metafied {
+			r = transform.NewReader(r, unmetafier{})
+		}
+		r = transform.NewReader(r, decoder())
+
+		scanner := bufio.NewScanner(r)
+		scanner.Split(lines.split(handler.split))
+		return scanner
+	}
+	scanner := newScanner(r)
+	if _, ok := multilineModes[cfg.Multiline]; !ok && cfg.Multiline != "" {
+		return stats, errors.New("Unknown multiline mode=" + cfg.Multiline)
+	}
+	if _, ok := timeUnits[cfg.TimeUnit]; !ok && cfg.TimeUnit != "" {
+		return stats, errors.New("Unknown time unit=" + cfg.TimeUnit)
+	}
+	if cfg.Sample < 0 || cfg.Sample > 1 {
+		return stats, fmt.Errorf("Invalid sample rate=%v, must be between 0 and 1", cfg.Sample)
+	}
+	if cfg.BatchSize > maxBatchSize {
+		return stats, fmt.Errorf("Invalid batch size=%d, must be at most %d", cfg.BatchSize, maxBatchSize)
+	}
+	if cfg.Verify < 0 {
+		return stats, fmt.Errorf("Invalid verify count=%d, must not be negative", cfg.Verify)
+	}
+	// both passes draw the same sample
+	if cfg.SampleSeed == 0 {
+		cfg.SampleSeed = time.Now().UnixNano()
+	}
+	switch cfg.OnInvalidBytes {
+	case "", "keep", "strip", "skip", "fail":
+	default:
+		return stats, errors.New("Unknown invalid bytes action=" + cfg.OnInvalidBytes)
+	}
+	switch cfg.OnOversize {
+	case "", "truncate", "skip":
+	default:
+		return stats, errors.New("Unknown oversize action=" + cfg.OnOversize)
+	}
+	switch cfg.OnFuture {
+	case "", "keep", "skip", "clamp", "fail":
+	default:
+		return stats, errors.New("Unknown future action=" + cfg.OnFuture)
+	}
+	handler.parse = cfg.parser(handler.parse, currentTimestamp)
+	if handler.ordered {
+		cfg.PreserveOrder = true
+	}
+
+	var (
+		lg = logger{cfg.LogLevel}
+		// entries waiting to be inserted when inserting in batches, and the lines the first and last start on
+		batch      []basicEntry
+		batchLines [2]int64
+		prog       = progress{log: lg}
+		// session of the entries and start time of the previous one when splitting sessions
+		session     = cfg.Session
+		lastStarted int64
+		hasLast     bool
+		// line the entry being handled starts on
+		line int64
+		// previous entry when collapsing duplicates, and whether it was inserted by this transaction
+		prev         previousEntry
+		prevInserted bool
+		// timed entries read so far when skipping duplicates within the file
+		seen    = seenEntries{}
+		sampled = cfg.sampler()
+	)
+
+	// per-entry logs are replaced by progress reports
+	logEntry := func(action string, entry basicEntry) {
+		if !cfg.Progress {
+			lg.debugf("%s line %d %+v\n", action, line, entry)
+		}
+	}
+
+	// entries to skip before the last Tail ones
+	var skip int64
+
+	// where reading started, to read seekable history again
+	seeker, seekable := r.(io.Seeker)
+	var start int64
+	if seekable {
+		start, err = seeker.Seek(0, io.SeekCurrent)
+		seekable = err == nil
+	}
+
+	// entries read from r, starting after the ones read by the import being resumed
+	var read int64
+	trackProgress := tx != nil && (cfg.CommitEvery > 0 || cfg.Resume)
+	if cfg.Resume && tx != nil {
+		read, err = tx.progress(ctx, file)
+		if err != nil {
+			return stats, err
+		}
+		if read > 0 {
+			lg.infof("Resuming %s after %d entries\n", file, read)
+		}
+	}
+	skipResumed := func(scanner *bufio.Scanner) error {
+		for i := int64(0); i < read; i++ {
+			_, ok, err := handler.read(scanner, nil)
+			if err != nil || !ok {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = skipResumed(scanner); err != nil {
+		return stats, err
+	}
+
+	// inserts the entries waiting in batch
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		inserted, err := tx.insertBatch(ctx, batch)
+		if err == nil {
+			stats.Inserted -= int64(len(batch)) - inserted
+			stats.Existing += int64(len(batch)) - inserted
+		} else {
+			err = errorAt(file, batchLines[0], fmt.Errorf("Unable to insert the entries up to line %d: %v", batchLines[1], err))
+		}
+		batch = batch[:0]
+		return err
+	}
+
+	// entries waiting in batch are kept as well when keeping a partial import or inserting without a transaction
+	defer func() {
+		if err != nil && (cfg.KeepPartial || cfg.NoTransaction) && tx != nil && len(batch) > 0 {
+			pending := int64(len(batch))
+			if flushErr := flush(); flushErr != nil {
+				lg.infof("Unable to insert %d pending entries: %v\n", pending, flushErr)
+				stats.Inserted -= pending
+			}
+		}
+	}()
+
+	// count entries first to rewind currentTimestamp if preserving order, find where the tail starts or confirm
+	confirm := cfg.Confirm != nil && tx != nil
+	if cfg.PreserveOrder || cfg.Tail > 0 || confirm {
+		// history is read twice, seekable files are read again from the start,
+		// anything else is buffered while counting
+		var buf *bytes.Buffer
+		if !seekable {
+			buf = &bytes.Buffer{}
+		}
+
+		counted := lines.lines
+		total, err := countEntries(ctx, cfg, scanner, handler, lines, currentTimestamp, buf, file)
+		if err != nil {
+			return stats, err
+		}
+		if cfg.Tail > 0 && total > cfg.Tail {
+			skip = total - cfg.Tail
+			total = cfg.Tail
+		}
+		if cfg.Limit > 0 && total > cfg.Limit {
+			total = cfg.Limit
+		}
+		prog.total = total
+		if cfg.PreserveOrder {
+			currentTimestamp -= total
+		}
+		if confirm {
+			ok, err := cfg.Confirm(displayName(file), total)
+			if err != nil {
+				return stats, err
+			}
+			if !ok {
+				return stats, ErrCanceled
+			}
+		}
+
+		if seekable {
+			_, err = seeker.Seek(start, io.SeekStart)
+			if err != nil {
+				return stats, err
+			}
+			lines.lines = cfg.lineOffset
+			scanner = newScanner(r)
+			if err = skipResumed(scanner); err != nil {
+				return stats, err
+			}
+		} else {
+			// buffered lines are already decoded, and start after the resumed ones
+			lines.lines = counted
+			scanner = bufio.NewScanner(buf)
+			scanner.Split(lines.split(handler.split))
+		}
+	}
+
+	next := parseInline(scanner, handler, lines, &currentTimestamp)
+	if cfg.Parsers > 1 {
+		var stop func()
+		next, stop = parseAhead(ctx, scanner, handler, lines, cfg.Parsers, currentTimestamp)
+		defer stop()
+	}
+
+	transform, err := cfg.newTransformer(ctx)
+	if err != nil {
+		return stats, err
+	}
+	if transform != nil {
+		defer transform.close()
+	}
+
+	rate := startThroughput(lg, displayName(file), cfg.StatsEvery, prog.total)
+	defer rate.stop()
+
+outer:
+	for {
+		if err = ctx.Err(); err != nil {
+			return stats, err
+		}
+		if cfg.Limit > 0 && stats.Inserted >= cfg.Limit {
+			// Inserted counts the entries waiting in batch, flushing them tells those already in history
+			if tx == nil || len(batch) == 0 {
+				break outer
+			}
+			if err = flush(); err != nil {
+				return stats, err
+			}
+			if stats.Inserted >= cfg.Limit {
+				break outer
+			}
+		}
+
+		pending, ok := next()
+		switch {
+		case pending.readErr != nil:
+			return stats, pending.readErr
+		case !ok:
+			break outer
+		}
+		read++
+		line = pending.line
+		if pending.raw == "" {
+			continue outer
+		}
+
+		parsed, err := pending.parsed, pending.parseErr
+		// entries without timestamp parsed ahead need the timestamp reached by now
+		if err == nil && parsed.synthesized && pending.timestamp != currentTimestamp {
+			parsed, err = handler.parse(pending.raw, currentTimestamp)
+		}
+		if err != nil {
+			stats.ParseErrors++
+			err = errorAt(file, line, err)
+			if cfg.SkipErrors {
+				lg.infof("Skipping invalid entry: %v\n", err)
+				continue outer
+			}
+			return stats, err
+		}
+		parsed.raw = pending.raw
+
+		if parsed.invalidBytes {
+			stats.InvalidBytes++
+			if cfg.OnInvalidBytes == "skip" {
+				logEntry("Skipping invalid bytes", parsed)
+				continue outer
+			}
+		}
+
+		if parsed.oversize {
+			stats.Oversize++
+			if cfg.OnOversize == "skip" {
+				logEntry("Skipping oversize", parsed)
+				continue outer
+			}
+		}
+
+		if parsed.future {
+			stats.Future++
+			if cfg.OnFuture == "skip" {
+				logEntry("Skipping future", parsed)
+				continue outer
+			}
+		}
+
+		if cfg.ignored(parsed.cmd) {
+			logEntry("Skipping", parsed)
+			stats.Ignored++
+			continue outer
+		}
+
+		if !cfg.inRange(parsed) {
+			logEntry("Skipping out of range", parsed)
+			stats.OutOfRange++
+			continue outer
+		}
+
+		parsed, ok, err = cfg.onEntry(parsed, currentTimestamp)
+		if err != nil {
+			return stats, err
+		}
+		if !ok {
+			logEntry("Skipping filtered", parsed)
+			stats.Ignored++
+			continue outer
+		}
+
+		if cfg.DedupConsecutive && prev.repeated(parsed) {
+			logEntry("Collapsing duplicate", parsed)
+			stats.Duplicates++
+			// the kept entry takes the time and exit status of the latest repeat, synthesized times aren't more recent
+			if prevInserted && !parsed.synthesized {
+				stats.addStarted(parsed)
+				row := cfg.stored(parsed)
+				if len(batch) > 0 {
+					last := &batch[len(batch)-1]
+					last.started, last.duration, last.exitStatus = row.started, row.duration, row.exitStatus
+				} else if err = tx.updateLast(ctx, row); err != nil {
+					return stats, err
+				}
+			}
+			continue outer
+		}
+		prevInserted = false
+
+		if cfg.DedupWithinFile && seen.repeated(parsed) {
+			logEntry("Skipping duplicate", parsed)
+			stats.Duplicates++
+			continue outer
+		}
+
+		if sampled != nil && !sampled() {
+			logEntry("Skipping unsampled", parsed)
+			continue outer
+		}
+
+		if skip > 0 {
+			logEntry("Skipping before tail", parsed)
+			skip--
+			continue outer
+		}
+
+		if transform != nil {
+			cmd, err := transform.transform(parsed.cmd)
+			var transformErr errTransform
+			if errors.As(err, &transformErr) && cfg.SkipErrors {
+				stats.ParseErrors++
+				lg.infof("Skipping entry: %v\n", errorAt(file, line, err))
+			} else if err != nil {
+				return stats, errorAt(file, line, err)
+			} else if cmd == "" {
+				logEntry("Skipping emptied", parsed)
+				stats.Ignored++
+			}
+			if err != nil || cmd == "" {
+				// entry was counted by countEntries, keep timestamps aligned
+				if cfg.PreserveOrder {
+					currentTimestamp++
+				}
+				continue outer
+			}
+			parsed.cmd = cmd
+		}
+
+		// start a new session when the gap to the previous entry is too large
+		if cfg.SessionGap > 0 {
+			if started, err := strconv.ParseInt(parsed.started, 10, 64); err == nil {
+				if hasLast && time.Duration(started-lastStarted)*time.Second > cfg.SessionGap {
+					session++
+				}
+				lastStarted, hasLast = started, true
+			}
+		}
+		if !parsed.hasSession {
+			parsed.session = session
+		}
+		// entries are handled in seconds, only the stored start time is scaled
+		row := cfg.stored(parsed)
+
+		// staged entries are compared with history all at once when merged
+		if cfg.SkipExisting && tx != nil && !tx.stage {
+			// entries waiting in the batch aren't in history yet
+			exists := batched(batch, row)
+			if !exists {
+				exists, err = tx.entryExists(ctx, row)
+				if err != nil {
+					return stats, err
+				}
+			}
+			if exists {
+				logEntry("Skipping existing", parsed)
+				stats.Existing++
+				// entry was counted by countEntries, keep timestamps aligned
+				if cfg.PreserveOrder {
+					currentTimestamp++
+				}
+				if cfg.Progress {
+					prog.add()
+				}
+				rate.add()
+				continue outer
+			}
+		}
+
+		switch {
+		case tx == nil:
+			logEntry("Would insert", parsed)
+			if cfg.visit != nil {
+				cfg.visit(parsed)
+			}
+		case cfg.BatchSize > 1:
+			logEntry("Inserting", parsed)
+			if len(batch) == 0 {
+				batchLines[0] = line
+			}
+			batchLines[1] = line
+			batch = append(batch, row)
+			if len(batch) == cfg.BatchSize {
+				err = flush()
+			}
+		default:
+			logEntry("Inserting", parsed)
+			var inserted bool
+			inserted, err = tx.insertEntry(ctx, row)
+			if err != nil {
+				return stats, errorAt(file, line, err)
+			}
+			if !inserted {
+				logEntry("Skipping existing", parsed)
+				stats.Existing++
+				if cfg.PreserveOrder {
+					currentTimestamp++
+				}
+				if cfg.Progress {
+					prog.add()
+				}
+				rate.add()
+				continue outer
+			}
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Inserted++
+		stats.addStarted(parsed)
+		prevInserted = tx != nil
+		if cfg.Progress {
+			prog.add()
+		}
+		rate.add()
+
+		// fast-forward current timestamp if preserving order
+		if cfg.PreserveOrder {
+			currentTimestamp++
+		}
+
+		// commit what was inserted so far, along with how far the file was read
+		if cfg.CommitEvery > 0 && tx != nil && stats.Inserted%cfg.CommitEvery == 0 {
+			if err = flush(); err != nil {
+				return stats, err
+			}
+			if err = tx.saveProgress(ctx, file, read); err != nil {
+				return stats, err
+			}
+			if err = tx.restart(ctx); err != nil {
+				return stats, err
+			}
+			// committed rows may be followed by other writers, don't update them
+			prevInserted = false
+			lg.debugf("Committed %d entries\n", stats.Inserted)
+		}
+	}
+
+	// flush remaining entries
+	if tx != nil {
+		if err = flush(); err != nil {
+			return stats, err
+		}
+	}
+	if trackProgress {
+		if err = tx.saveProgress(ctx, file, read); err != nil {
+			return stats, err
+		}
+	}
+
+	// final report, unless the last entry already triggered one
+	if cfg.Progress && (prog.done == 0 || prog.done%progressInterval != 0) {
+		prog.report()
+	}
+
+	return stats, nil
+}
+
+// Counts the entries that aren't ignored or out of range, lines read are written to buf if not nil
+func countEntries(ctx context.Context, cfg Config, scanner *bufio.Scanner, handler formatHandler, lines *lineCounter, currentTimestamp int64, buf *bytes.Buffer, file string) (int64, error) {
+	var (
+		lineCount int64
+		prev      previousEntry
+		seen      = seenEntries{}
+		sampled   = cfg.sampler()
+	)
+
+	// replicate loop of readAndInsert() to count total entry need to be inserted
+outer:
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+
+		line := lines.lines + 1
+		entry, ok, err := handler.read(scanner, buf)
+		switch {
+		case err != nil:
+			return 0, err
+		case !ok:
+			break outer
+		case entry == "":
+			continue outer
+		}
+
+		parsed, err := handler.parse(entry, currentTimestamp)
+		if err != nil {
+			if cfg.SkipErrors {
+				continue outer
+			}
+			return 0, errorAt(file, line, err)
+		}
+
+		if parsed.invalidBytes && cfg.OnInvalidBytes == "skip" {
+			continue outer
+		}
+		if parsed.oversize && cfg.OnOversize == "skip" {
+			continue outer
+		}
+		if parsed.future && cfg.OnFuture == "skip" {
+			continue outer
+		}
+		if cfg.ignored(parsed.cmd) || !cfg.inRange(parsed) {
+			continue outer
+		}
+		parsed, ok, err = cfg.onEntry(parsed, currentTimestamp)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue outer
+		}
+		if cfg.DedupConsecutive && prev.repeated(parsed) {
+			continue outer
+		}
+		if cfg.DedupWithinFile && seen.repeated(parsed) {
+			continue outer
+		}
+		if sampled != nil && !sampled() {
+			continue outer
+		}
+
+		lineCount++
+	}
+
+	return lineCount, nil
+}
+
+// command and place of the previous entry, to detect consecutive duplicates
+type previousEntry struct {
+	cmd, host, dir string
+	ok             bool
+}
+
+// Reports whether entry repeats the command of the previous entry in the same place, and remembers entry
+func (p *previousEntry) repeated(entry basicEntry) bool {
+	repeated := p.ok && p.cmd == entry.cmd && p.host == entry.host && p.dir == entry.dir
+	*p = previousEntry{entry.cmd, entry.host, entry.dir, true}
+	return repeated
+}
+
+// Reports whether the batch entries holds an entry with the start time, command and place of entry
+func batched(entries []basicEntry, entry basicEntry) bool {
+	for _, e := range entries {
+		if e.started == entry.started && e.cmd == entry.cmd && e.host == entry.host && e.dir == entry.dir {
+			return true
+		}
+	}
+	return false
+}
+
+// start time, command and place of the timed entries read from a file, to detect duplicates
+type seenEntries map[[4]string]struct{}
+
+// Reports whether entry repeats the start time, command and place of an earlier entry, and remembers entry.
+// Entries without timestamp are never duplicates
+func (s seenEntries) repeated(entry basicEntry) bool {
+	if entry.synthesized {
+		return false
+	}
+	key := [4]string{entry.started, entry.cmd, entry.host, entry.dir}
+	if _, ok := s[key]; ok {
+		return true
+	}
+	s[key] = struct{}{}
+	return false
+}
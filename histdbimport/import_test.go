@@ -0,0 +1,1240 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// time of the test imports, given to entries without timestamp
+var testBaseTime = time.Unix(1700000000, 0)
+
+// history row joined with its command and place
+type historyRow struct {
+	session    int64
+	exitStatus int64
+	started    int64
+	duration   int64
+	argv       string
+	host       string
+	dir        string
+}
+
+// Returns the settings of a test import into db, from host "host" and dir "/dir"
+func testConfig(db string) Config {
+	return Config{
+		DatabaseURL:  db,
+		CreateSchema: true,
+		Host:         "host",
+		Dir:          "/dir",
+		BaseTime:     testBaseTime,
+		LogLevel:     LogError,
+	}
+}
+
+// in-memory databases opened, to name the next one
+var testDBs int
+
+// Opens an in-memory database of its own for the test, which lasts until the test ends as the returned connection
+// keeps it open while Import opens and closes its own. Returns the DSN to import into
+func openTestDB(t testing.TB) (*sql.DB, string) {
+	testDBs++
+	dsn := "file:test" + strconv.Itoa(testDBs) + "?mode=memory&cache=shared"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	return db, dsn
+}
+
+// Writes the histories to files of the test and adds them to cfg
+func addHistories(t testing.TB, cfg *Config, histories ...string) {
+	dir := t.TempDir()
+	for i, history := range histories {
+		path := filepath.Join(dir, "history"+strconv.Itoa(i))
+		if err := ioutil.WriteFile(path, []byte(history), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg.HistoryFiles = append(cfg.HistoryFiles, HistorySource{File: path})
+	}
+}
+
+// Imports the histories with cfg into a new in-memory database and returns the resulting history rows
+func importHistories(t *testing.T, cfg Config, histories ...string) ([]historyRow, Stats) {
+	t.Helper()
+	db, dsn := openTestDB(t)
+	if cfg.DatabaseURL == "" {
+		cfg.DatabaseURL = dsn
+	}
+	addHistories(t, &cfg, histories...)
+	stats, err := Import(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queryHistory(t, db), stats
+}
+
+// Returns the rows of history in insert order
+func queryHistory(t testing.TB, db *sql.DB) []historyRow {
+	t.Helper()
+	rows, err := db.Query(`
+		SELECT history.session, history.exit_status, history.start_time, history.duration, commands.argv, places.host, places.dir
+		FROM history JOIN commands ON commands.id = history.command_id JOIN places ON places.id = history.place_id
+		ORDER BY history.id;
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var history []historyRow
+	for rows.Next() {
+		var row historyRow
+		if err := rows.Scan(&row.session, &row.exitStatus, &row.started, &row.duration, &row.argv, &row.host, &row.dir); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, row)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+// Returns the values of the only column selected by query
+func mustQueryStrings(t testing.TB, db *sql.DB, query string) []string {
+	t.Helper()
+	values, err := queryStrings(db, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+// Returns the commands of rows
+func commandsOf(rows []historyRow) []string {
+	var commands []string
+	for _, row := range rows {
+		commands = append(commands, row.argv)
+	}
+	return commands
+}
+
+func TestImport(t *testing.T) {
+	db, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.Format = "zsh"
+	addHistories(t, &cfg,
+		": 1600000000:3;make\n: 1600000010:0;git status\n: 1600000020:1;make\n",
+		": 1600000030:0;git status\n",
+	)
+	cfg.HistoryFiles[1].Host = "laptop"
+
+	stats, err := Import(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Inserted != 4 {
+		t.Errorf("inserted %d entries, want 4", stats.Inserted)
+	}
+
+	want := []historyRow{
+		{0, 0, 1600000000, 3, "make", "host", "/dir"},
+		{0, 0, 1600000010, 0, "git status", "host", "/dir"},
+		{0, 0, 1600000020, 1, "make", "host", "/dir"},
+		{0, 0, 1600000030, 0, "git status", "laptop", "/dir"},
+	}
+	if got := queryHistory(t, db); !reflect.DeepEqual(got, want) {
+		t.Errorf("history = %v, want %v", got, want)
+	}
+	// repeated commands and places reuse their rows
+	if got, want := mustQueryStrings(t, db, "SELECT argv FROM commands ORDER BY id;"), []string{"make", "git status"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	if got, want := mustQueryStrings(t, db, "SELECT host || ':' || dir FROM places ORDER BY id;"), []string{"host:/dir", "laptop:/dir"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("places = %q, want %q", got, want)
+	}
+}
+
+func TestImportSkipExisting(t *testing.T) {
+	db, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.SkipExisting = true
+	addHistories(t, &cfg, ": 1600000000:0;make\n: 1600000010:0;make test\n")
+
+	for i := 0; i < 2; i++ {
+		if _, err := Import(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := queryHistory(t, db); len(got) != 2 {
+		t.Errorf("imported twice into %d rows, want 2", len(got))
+	}
+}
+
+// An entry repeated within the history is skipped whether or not its first occurrence is still batched
+func TestImportSkipExistingRepeated(t *testing.T) {
+	for _, size := range []int{1, 500} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.SkipExisting = true
+			cfg.BatchSize = size
+			rows, stats := importHistories(t, cfg, ": 1600000000:0;make\n: 1600000010:0;make test\n: 1600000000:0;make\n")
+			if want := []string{"make", "make test"}; !reflect.DeepEqual(commandsOf(rows), want) {
+				t.Errorf("commands = %q, want %q", commandsOf(rows), want)
+			}
+			if stats.Inserted != 2 || stats.Existing != 1 {
+				t.Errorf("inserted=%d existing=%d, want 2 and 1", stats.Inserted, stats.Existing)
+			}
+		})
+	}
+}
+
+// Entries found in history when their batch is flushed don't count towards the limit
+func TestImportLimitDedupHistory(t *testing.T) {
+	history := ": 1600000000:0;a\n: 1600000001:0;b\n: 1600000002:0;c\n: 1600000003:0;d\n: 1600000004:0;e\n"
+	for _, size := range []int{1, 500} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.DedupHistory = true
+			cfg.BatchSize = size
+			addHistories(t, &cfg, ": 1600000000:0;a\n: 1600000001:0;b\n")
+			if _, err := Import(context.Background(), cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg.HistoryFiles = nil
+			cfg.Limit = 2
+			addHistories(t, &cfg, history)
+			stats, err := Import(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a", "b", "c", "d"}; !reflect.DeepEqual(commandsOf(queryHistory(t, db)), want) {
+				t.Errorf("commands = %q, want %q", commandsOf(queryHistory(t, db)), want)
+			}
+			if stats.Inserted != 2 || stats.Existing != 2 {
+				t.Errorf("inserted=%d existing=%d, want 2 and 2", stats.Inserted, stats.Existing)
+			}
+		})
+	}
+}
+
+func TestMapDir(t *testing.T) {
+	users := map[string]string{"/Users/alice": "/home/alice", "/Users/alice/src/": "/src/"}
+	tests := []struct {
+		dirMap map[string]string
+		dir    string
+		want   string
+	}{
+		{users, "/Users/alice", "/home/alice"},
+		{users, "/Users/alice/", "/home/alice"},
+		{users, "/Users/alice/docs", "/home/alice/docs"},
+		// prefixes only match whole path components
+		{users, "/Users/alicex", "/Users/alicex"},
+		{users, "/Users/alicex/docs", "/Users/alicex/docs"},
+		{users, "/Users", "/Users"},
+		// the longest prefix wins, with or without its trailing slash
+		{users, "/Users/alice/src", "/src"},
+		{users, "/Users/alice/src/go", "/src/go"},
+		{users, "/Users/alice/srcs", "/home/alice/srcs"},
+		// the root maps every absolute dir, and a dir may map to the root
+		{map[string]string{"/": "/mnt/old"}, "/", "/mnt/old"},
+		{map[string]string{"/": "/mnt/old"}, "/etc", "/mnt/old/etc"},
+		{map[string]string{"/": "/mnt/old"}, "relative", "relative"},
+		{map[string]string{"/home/alice": "/"}, "/home/alice", "/"},
+		{map[string]string{"/home/alice/": "/"}, "/home/alice/bin", "/bin"},
+		{nil, "/home/alice", "/home/alice"},
+	}
+	for _, test := range tests {
+		cfg := Config{DirMap: test.dirMap}
+		if got := cfg.mapDir(test.dir); got != test.want {
+			t.Errorf("mapDir(%q) with %v = %q, want %q", test.dir, test.dirMap, got, test.want)
+		}
+	}
+}
+
+// Runs of the same command are collapsed into their first entry, whether it is still batched, already inserted
+// or skipped before the tail
+func TestImportDedupConsecutive(t *testing.T) {
+	history := ": 1600000001:0;make\n: 1600000002:0;ls\n: 1600000003:0;ls\n: 1600000004:2;ls\n: 1600000005:0;make\n: 1600000006:1;make\n"
+	row := func(started, duration int64, argv string) historyRow {
+		return historyRow{started: started, duration: duration, argv: argv, host: "host", dir: "/dir"}
+	}
+	collapsed := []historyRow{row(1600000001, 0, "make"), row(1600000004, 2, "ls"), row(1600000006, 1, "make")}
+	tests := []struct {
+		name      string
+		configure func(cfg *Config)
+		want      []historyRow
+	}{
+		{"batch=1", func(cfg *Config) { cfg.BatchSize = 1 }, collapsed},
+		// the first ls ends a batch, its repeats update the inserted row
+		{"batch=2", func(cfg *Config) { cfg.BatchSize = 2 }, collapsed},
+		{"batch=500", func(cfg *Config) { cfg.BatchSize = 500 }, collapsed},
+		// the tail is counted in collapsed entries
+		{"tail", func(cfg *Config) { cfg.Tail = 2 }, collapsed[1:]},
+		{"tail batch=1", func(cfg *Config) { cfg.Tail = 2; cfg.BatchSize = 1 }, collapsed[1:]},
+		// rows committed before a repeat aren't updated
+		{"commit every", func(cfg *Config) { cfg.CommitEvery = 2 }, []historyRow{row(1600000001, 0, "make"), row(1600000002, 0, "ls"), row(1600000006, 1, "make")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.DedupConsecutive = true
+			test.configure(&cfg)
+			rows, stats := importHistories(t, cfg, history)
+			if !reflect.DeepEqual(rows, test.want) {
+				t.Errorf("history = %v, want %v", rows, test.want)
+			}
+			if stats.Inserted != int64(len(test.want)) {
+				t.Errorf("inserted %d, want %d", stats.Inserted, len(test.want))
+			}
+		})
+	}
+}
+
+// An import committing every 2 entries fails on the third, resuming it imports the rest without duplicating the first two
+func TestImportDedupWithinFile(t *testing.T) {
+	// merged history repeating timed entries, the repeated untimed command isn't a duplicate
+	history := ": 1600000000:0;a\n: 1600000001:0;b\n: 1600000000:0;a\nc\nc\n: 1600000001:0;b\n: 1600000002:0;d\n: 1600000000:0;a\n"
+	tests := []struct {
+		tail int64
+		want []string
+	}{
+		{0, []string{"a", "b", "c", "c", "d"}},
+		{3, []string{"c", "c", "d"}},
+		{2, []string{"c", "d"}},
+	}
+	for _, test := range tests {
+		// entries are counted by countEntries first when preserving order or importing the tail
+		for _, preserveOrder := range []bool{false, true} {
+			t.Run(fmt.Sprintf("tail %d preserve order %v", test.tail, preserveOrder), func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "zsh"
+				cfg.DedupWithinFile = true
+				cfg.Tail = test.tail
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				if stats.Duplicates != 3 {
+					t.Errorf("%d duplicates, want 3", stats.Duplicates)
+				}
+				for i, row := range rows {
+					if row.argv != "c" {
+						continue
+					}
+					want := testBaseTime.Unix()
+					if preserveOrder {
+						want -= int64(len(rows) - i)
+					}
+					if row.started != want {
+						t.Errorf("start time of %q = %d, want %d", row.argv, row.started, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	for _, size := range []int{1, 500} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.BatchSize = size
+			cfg.CommitEvery = 2
+			addHistories(t, &cfg, ": 1600000001:0;a\n: 1600000002:0;b\n: 1600000003:0;c\n: 1600000004:0;d\n: 1600000005:0;e\n")
+			cfg.OnEntry = func(e *Entry) (bool, error) {
+				if e.Command == "c" {
+					return false, errors.New("interrupted")
+				}
+				return true, nil
+			}
+			if _, err := Import(context.Background(), cfg); err == nil {
+				t.Fatal("import didn't fail")
+			}
+			if got, want := commandsOf(queryHistory(t, db)), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("commands after failing = %q, want %q", got, want)
+			}
+			if got, want := mustQueryStrings(t, db, "SELECT entries FROM histdbimport_progress;"), []string{"2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("progress after failing = %v, want %v", got, want)
+			}
+
+			cfg.OnEntry = nil
+			cfg.Resume = true
+			stats, err := Import(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := commandsOf(queryHistory(t, db)), []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("commands after resuming = %q, want %q", got, want)
+			}
+			if stats.Inserted != 3 {
+				t.Errorf("resumed import inserted %d, want 3", stats.Inserted)
+			}
+			if got, want := mustQueryStrings(t, db, "SELECT entries FROM histdbimport_progress;"), []string{"5"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("progress after resuming = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// Staged entries are merged into the same rows as entries inserted directly
+func TestImportStaged(t *testing.T) {
+	existing := ": 1600000001:0;a\n"
+	history := ": 1600000001:0;a\n: 1600000002:3;b\n: 1600000002:3;b\n: 1600000003:0;echo c\\\nd\n: 1600000004:0;a\n"
+	for _, skipExisting := range []bool{false, true} {
+		for _, size := range []int{1, 500} {
+			t.Run(fmt.Sprintf("skip-existing=%v/batch=%d", skipExisting, size), func(t *testing.T) {
+				var got [2][]historyRow
+				var stats [2]Stats
+				for i, stage := range []bool{false, true} {
+					db, dsn := openTestDB(t)
+					cfg := testConfig(dsn)
+					addHistories(t, &cfg, existing)
+					if _, err := Import(context.Background(), cfg); err != nil {
+						t.Fatal(err)
+					}
+
+					cfg.HistoryFiles = nil
+					cfg.SkipExisting = skipExisting
+					cfg.BatchSize = size
+					cfg.Stage = stage
+					addHistories(t, &cfg, history)
+					var err error
+					if stats[i], err = Import(context.Background(), cfg); err != nil {
+						t.Fatal(err)
+					}
+					got[i] = queryHistory(t, db)
+				}
+
+				if !reflect.DeepEqual(got[1], got[0]) {
+					t.Errorf("staged history = %v, want %v", got[1], got[0])
+				}
+				if stats[1].Inserted != stats[0].Inserted || stats[1].Existing != stats[0].Existing {
+					t.Errorf("staged inserted=%d existing=%d, want %d and %d", stats[1].Inserted, stats[1].Existing, stats[0].Inserted, stats[0].Existing)
+				}
+				want := 6
+				if skipExisting {
+					want = 4
+				}
+				if len(got[0]) != want {
+					t.Errorf("history has %d rows, want %d", len(got[0]), want)
+				}
+			})
+		}
+	}
+}
+
+func TestParseRelative(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"now", 0},
+		{"today", 0},
+		{" Now ", 0},
+		{"yesterday", 24 * time.Hour},
+		{"5m ago", 5 * time.Minute},
+		{"5 m ago", 5 * time.Minute},
+		{"2 hours ago", 2 * time.Hour},
+		{"1 hour ago", time.Hour},
+		{"90 SECONDS AGO", 90 * time.Second},
+		{"3d ago", 3 * 24 * time.Hour},
+		{"2 weeks ago", 14 * 24 * time.Hour},
+	}
+	for _, test := range tests {
+		got, err := parseRelative(test.value)
+		if err != nil {
+			t.Errorf("parseRelative(%q): %v", test.value, err)
+		} else if got != test.want {
+			t.Errorf("parseRelative(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+
+	for _, value := range []string{"", "5m", "ago", "5 ago", "-5m ago", "5 fortnights ago", "1.5h ago", "tomorrow", "in 5m"} {
+		if got, err := parseRelative(value); err == nil {
+			t.Errorf("parseRelative(%q) = %v, want an error", value, got)
+		}
+	}
+}
+
+// Relative start times are relative to the import time
+func TestImportRelative(t *testing.T) {
+	cfg := testConfig("")
+	cfg.TimeFormat = "relative"
+	cfg.BaseTime = time.Unix(1700000000, 0)
+	rows, _ := importHistories(t, cfg, ": 5m ago:0;a\n: 2 hours ago:0;b\n: yesterday:0;c\n: now:0;d\n: 1600000000:0;e\n")
+	var started []int64
+	for _, row := range rows {
+		started = append(started, row.started)
+	}
+	want := []int64{1700000000 - 300, 1700000000 - 7200, 1700000000 - 86400, 1700000000, 1600000000}
+	if !reflect.DeepEqual(started, want) {
+		t.Errorf("start times = %v, want %v", started, want)
+	}
+
+	_, dsn := openTestDB(t)
+	cfg.DatabaseURL = dsn
+	cfg.HistoryFiles = nil
+	addHistories(t, &cfg, ": soon:0;a\n")
+	if _, err := Import(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "relative time=soon") {
+		t.Errorf("err = %v, want an invalid relative time", err)
+	}
+}
+
+func TestImportRange(t *testing.T) {
+	history := ": 1600000099:0;before\nuntimed\n: 1600000100:0;since\n: 1600000150:0;middle\n: 1600000200:0;until\n: 1600000201:0;after\n"
+	tests := []struct {
+		name           string
+		since, until   int64
+		excludeUntimed bool
+		want           []string
+	}{
+		// both bounds are inclusive
+		{"since until", 1600000100, 1600000200, false, []string{"untimed", "since", "middle", "until"}},
+		{"since", 1600000150, 0, false, []string{"untimed", "middle", "until", "after"}},
+		{"until", 0, 1600000099, false, []string{"before", "untimed"}},
+		{"exclude untimed", 1600000100, 1600000200, true, []string{"since", "middle", "until"}},
+		{"empty range", 1600000101, 1600000149, true, nil},
+	}
+	for _, test := range tests {
+		// entries are counted by countEntries first when preserving order
+		for _, preserveOrder := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s preserve order %v", test.name, preserveOrder), func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "zsh"
+				if test.since != 0 {
+					cfg.Since = time.Unix(test.since, 0)
+				}
+				if test.until != 0 {
+					cfg.Until = time.Unix(test.until, 0)
+				}
+				cfg.ExcludeUntimed = test.excludeUntimed
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				if want := int64(6 - len(test.want)); stats.OutOfRange != want {
+					t.Errorf("%d entries out of range, want %d", stats.OutOfRange, want)
+				}
+				// the synthesized start time isn't compared to the range, it counts the entries imported around it
+				for i, row := range rows {
+					if row.argv != "untimed" {
+						continue
+					}
+					want := testBaseTime.Unix()
+					if preserveOrder {
+						want -= int64(len(rows) - i)
+					}
+					if row.started != want {
+						t.Errorf("start time of %q = %d, want %d", row.argv, row.started, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		cmd        string
+		ignoreCase bool
+		want       bool
+	}{
+		{"ls", false, true},
+		{" ls", false, true},
+		{"cd \t", false, true},
+		// left by the backslash of a multi-line entry
+		{"cd\n", false, true},
+		{"\nls\n", false, true},
+		{"LS", false, false},
+		{"LS", true, true},
+		{" Cd\n", true, true},
+		{"ls -la", true, false},
+		{"lsblk", false, false},
+	}
+	for _, test := range tests {
+		cfg := Config{Ignore: []string{"ls", " cd "}, IgnoreCase: test.ignoreCase}
+		if got := cfg.ignored(test.cmd); got != test.want {
+			t.Errorf("ignored(%q) with ignore case %v = %v, want %v", test.cmd, test.ignoreCase, got, test.want)
+		}
+	}
+}
+
+func TestImportIgnore(t *testing.T) {
+	history := ": 1600000000:0;ls\\\n\n: 1600000001:0; cd \n: 1600000002:0;LS\n: 1600000003:0;make\n"
+	tests := []struct {
+		ignoreCase bool
+		want       []string
+	}{
+		{false, []string{"LS", "make"}},
+		{true, []string{"make"}},
+	}
+	for _, test := range tests {
+		// entries are counted by countEntries first when preserving order
+		for _, preserveOrder := range []bool{false, true} {
+			name := fmt.Sprintf("ignore case %v preserve order %v", test.ignoreCase, preserveOrder)
+			t.Run(name, func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "zsh"
+				cfg.Ignore = []string{"ls", "cd"}
+				cfg.IgnoreCase = test.ignoreCase
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				if want := int64(4 - len(test.want)); stats.Ignored != want {
+					t.Errorf("ignored %d entries, want %d", stats.Ignored, want)
+				}
+			})
+		}
+	}
+}
+
+func TestImportIgnoreRegex(t *testing.T) {
+	// untimed entries, their start times show whether countEntries skipped the same entries
+	history := "git status\nmysql -u root --password=secret\nmake\nls\ngit push\n\tgit log\n"
+	tests := []struct {
+		name    string
+		ignore  []string
+		regexps []string
+		want    []string
+	}{
+		{"regex", nil, []string{`^git `}, []string{"mysql -u root --password=secret", "make", "ls", "\tgit log"}},
+		{"regexps", nil, []string{`^\s*git `, `--password`}, []string{"make", "ls"}},
+		{"with ignore", []string{"ls"}, []string{`^\s*git `, `--password`}, []string{"make"}},
+		{"no match", nil, []string{`^docker `}, []string{"git status", "mysql -u root --password=secret", "make", "ls", "git push", "\tgit log"}},
+	}
+	for _, test := range tests {
+		for _, preserveOrder := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s preserve order %v", test.name, preserveOrder), func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "zsh"
+				cfg.Ignore = test.ignore
+				for _, re := range test.regexps {
+					cfg.IgnoreRegex = append(cfg.IgnoreRegex, regexp.MustCompile(re))
+				}
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				if want := int64(6 - len(test.want)); stats.Ignored != want {
+					t.Errorf("ignored %d entries, want %d", stats.Ignored, want)
+				}
+				for i, row := range rows {
+					want := testBaseTime.Unix()
+					if preserveOrder {
+						want -= int64(len(rows) - i)
+					}
+					if row.started != want {
+						t.Errorf("start time of %q = %d, want %d", row.argv, row.started, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestImportOnly(t *testing.T) {
+	history := "ssh host\ndocker ps\n ssh  other\nls\nsshfs host:/ mnt\ndocker run --password=secret img\n"
+	tests := []struct {
+		name        string
+		only        []string
+		onlyRegexps []string
+		ignore      []string
+		want        []string
+	}{
+		{"only", []string{"ssh host", "ls"}, nil, nil, []string{"ssh host", "ls"}},
+		{"only regex", nil, []string{`^\s*ssh\s`}, nil, []string{"ssh host", " ssh  other"}},
+		{"either", []string{"ls"}, []string{`^docker `}, nil, []string{"docker ps", "ls", "docker run --password=secret img"}},
+		// ignore wins over only
+		{"ignored", nil, []string{`^docker `}, []string{"docker ps"}, []string{"docker run --password=secret img"}},
+		{"no match", []string{"make"}, nil, nil, nil},
+	}
+	for _, test := range tests {
+		for _, preserveOrder := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s preserve order %v", test.name, preserveOrder), func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "zsh"
+				cfg.Only = test.only
+				for _, re := range test.onlyRegexps {
+					cfg.OnlyRegex = append(cfg.OnlyRegex, regexp.MustCompile(re))
+				}
+				cfg.Ignore = test.ignore
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				if want := int64(6 - len(test.want)); stats.Ignored != want {
+					t.Errorf("ignored %d entries, want %d", stats.Ignored, want)
+				}
+				// start times show whether countEntries skipped the same entries
+				for i, row := range rows {
+					want := testBaseTime.Unix()
+					if preserveOrder {
+						want -= int64(len(rows) - i)
+					}
+					if row.started != want {
+						t.Errorf("start time of %q = %d, want %d", row.argv, row.started, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestImportMultiline(t *testing.T) {
+	history := ": 1600000000:0;for f in *; do\\\n  echo $f\\\ndone\n: 1600000001:0;make\n"
+	tests := []struct {
+		mode string
+		want string
+	}{
+		{"", "for f in *; do\n  echo $f\ndone"},
+		{"preserve", "for f in *; do\n  echo $f\ndone"},
+		{"collapse", "for f in *; do   echo $f done"},
+		{"escape", `for f in *; do\n  echo $f\ndone`},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "zsh"
+			cfg.Multiline = test.mode
+
+			rows, _ := importHistories(t, cfg, history)
+			if got, want := commandsOf(rows), []string{test.want, "make"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("commands = %q, want %q", got, want)
+			}
+		})
+	}
+
+	_, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.Multiline = "fold"
+	addHistories(t, &cfg, history)
+	if _, err := Import(context.Background(), cfg); err == nil {
+		t.Error("imported with an unknown multiline mode")
+	}
+}
+
+// Returns a zsh history of n entries cycling through distinct commands
+func benchmarkHistory(n, distinct int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, ": %d:0;make target%d\n", 1600000000+i, i%distinct)
+	}
+	return sb.String()
+}
+
+// Imports history into a new database per iteration, with the given settings
+func benchmarkImport(b *testing.B, history string, configure func(cfg *Config)) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		_, dsn := openTestDB(b)
+		cfg := testConfig(dsn)
+		cfg.Format = "zsh"
+		configure(&cfg)
+		addHistories(b, &cfg, history)
+		b.StartTimer()
+
+		if _, err := Import(context.Background(), cfg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Inserts entries one by one, with their command and place rowids cached by the transaction
+func BenchmarkInsertEntry(b *testing.B) {
+	for _, distinct := range []int{100, 10000} {
+		history := benchmarkHistory(10000, distinct)
+		b.Run(fmt.Sprintf("distinct=%d", distinct), func(b *testing.B) {
+			benchmarkImport(b, history, func(cfg *Config) { cfg.BatchSize = 1 })
+		})
+	}
+}
+
+// Compares inserting entries one by one with multi-row inserts, both using the cached command and place rowids
+func BenchmarkInsertBatch(b *testing.B) {
+	for _, distinct := range []int{100, 10000} {
+		history := benchmarkHistory(10000, distinct)
+		for _, size := range []int{1, 500} {
+			size := size
+			b.Run(fmt.Sprintf("distinct=%d/batch=%d", distinct, size), func(b *testing.B) {
+				benchmarkImport(b, history, func(cfg *Config) { cfg.BatchSize = size })
+			})
+		}
+	}
+}
+
+func TestImportInvalidBytes(t *testing.T) {
+	// NUL, SOH and BEL are invalid, tabs and newlines aren't
+	history := ": 1600000000:0;echo a\x00b\n: 1600000001:0;printf \x01\tx\n: 1600000002:0;ls\\\n\t-l\n: 1600000003:0;echo \x07done\n"
+	tests := []struct {
+		action  string
+		want    []string
+		invalid int64
+		err     string
+	}{
+		{"", []string{"echo a\x00b", "printf \x01\tx", "ls\n\t-l", "echo \x07done"}, 0, ""},
+		{"keep", []string{"echo a\x00b", "printf \x01\tx", "ls\n\t-l", "echo \x07done"}, 0, ""},
+		{"strip", []string{"echo ab", "printf \tx", "ls\n\t-l", "echo done"}, 3, ""},
+		{"skip", []string{"ls\n\t-l"}, 3, ""},
+		{"fail", nil, 0, `Invalid bytes in command="echo a\x00b"`},
+	}
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.OnInvalidBytes = test.action
+			addHistories(t, &cfg, history)
+
+			stats, err := Import(context.Background(), cfg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err = %v, want %s", err, test.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := commandsOf(queryHistory(t, db)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+			if stats.InvalidBytes != test.invalid {
+				t.Errorf("%d entries with invalid bytes, want %d", stats.InvalidBytes, test.invalid)
+			}
+		})
+	}
+
+	t.Run("unknown", func(t *testing.T) {
+		_, dsn := openTestDB(t)
+		cfg := testConfig(dsn)
+		cfg.OnInvalidBytes = "drop"
+		addHistories(t, &cfg, history)
+		if _, err := Import(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "invalid bytes action=drop") {
+			t.Errorf("err = %v, want an unknown action", err)
+		}
+	})
+}
+
+func TestImportMaxCommandLength(t *testing.T) {
+	// lengths are counted in characters, not bytes, the plain format leaves bytes zsh would unmetafy alone
+	history := "ls -l\nécho «ünïcödé»\n日本語のコマンドです\nmake all\n"
+	tests := []struct {
+		action string
+		want   []string
+	}{
+		{"", []string{"ls -l", "écho «ü…", "日本語のコマン…", "make all"}},
+		{"truncate", []string{"ls -l", "écho «ü…", "日本語のコマン…", "make all"}},
+		{"skip", []string{"ls -l", "make all"}},
+	}
+	for _, test := range tests {
+		// oversize entries are skipped by countEntries too when preserving order
+		for _, preserveOrder := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%q preserve order %v", test.action, preserveOrder), func(t *testing.T) {
+				cfg := testConfig("")
+				cfg.Format = "plain"
+				cfg.MaxCommandLength = 8
+				cfg.OnOversize = test.action
+				cfg.PreserveOrder = preserveOrder
+
+				rows, stats := importHistories(t, cfg, history)
+				if got := commandsOf(rows); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("commands = %q, want %q", got, test.want)
+				}
+				for _, row := range rows {
+					if !utf8.ValidString(row.argv) {
+						t.Errorf("command %q isn't valid UTF-8", row.argv)
+					}
+				}
+				if stats.Oversize != 2 {
+					t.Errorf("%d oversize entries, want 2", stats.Oversize)
+				}
+				if preserveOrder && rows[len(rows)-1].started != testBaseTime.Unix()-1 {
+					t.Errorf("start time of the last entry = %d, want %d", rows[len(rows)-1].started, testBaseTime.Unix()-1)
+				}
+			})
+		}
+	}
+}
+
+func TestImportFuture(t *testing.T) {
+	// the clock is a little after the import time, start times later than an hour after the clock are in the future
+	clock := testBaseTime.Add(100 * time.Second)
+	history := ": 1700000000:0;now\n: 1700003700:0;skewed\n: 1700003701:0;late\nls\n: 1800000000:0;later\n"
+	type entry struct {
+		cmd     string
+		started int64
+	}
+	tests := []struct {
+		action string
+		want   []entry
+		err    string
+	}{
+		{"", []entry{{"now", 1700000000}, {"skewed", 1700003700}, {"late", 1700003701}, {"ls", 1700000000}, {"later", 1800000000}}, ""},
+		{"keep", []entry{{"now", 1700000000}, {"skewed", 1700003700}, {"late", 1700003701}, {"ls", 1700000000}, {"later", 1800000000}}, ""},
+		{"skip", []entry{{"now", 1700000000}, {"skewed", 1700003700}, {"ls", 1700000000}}, ""},
+		{"clamp", []entry{{"now", 1700000000}, {"skewed", 1700003700}, {"late", 1700000100}, {"ls", 1700000000}, {"later", 1700000100}}, ""},
+		{"fail", nil, "Start time 1700003701 is more than 1h0m0s in the future"},
+	}
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.MaxSkew = time.Hour
+			cfg.OnFuture = test.action
+			cfg.now = func() time.Time { return clock }
+			addHistories(t, &cfg, history)
+
+			stats, err := Import(context.Background(), cfg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err = %v, want %s", err, test.err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			var got []entry
+			for _, row := range queryHistory(t, db) {
+				got = append(got, entry{row.argv, row.started})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("entries = %v, want %v", got, test.want)
+			}
+			if stats.Future != 2 {
+				t.Errorf("%d future entries, want 2", stats.Future)
+			}
+		})
+	}
+}
+
+func TestOpenHistory(t *testing.T) {
+	history := ": 1600000000:0;ls\n: 1600000001:0;make\n"
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(history))
+	gz.Close()
+
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"plain", []byte(history), history},
+		{"gzip", compressed.Bytes(), history},
+		// too short to be sniffed
+		{"one byte", []byte{0x1f}, "\x1f"},
+		{"empty", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, test.name)
+			if err := ioutil.WriteFile(path, test.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			check := func(r io.ReadCloser, seekable bool) {
+				t.Helper()
+				defer r.Close()
+				got, err := ioutil.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != test.want {
+					t.Errorf("read %q, want %q", got, test.want)
+				}
+				// plain files are read twice from the start instead of being buffered when preserving order
+				if _, ok := r.(io.Seeker); ok != seekable {
+					t.Errorf("seekable = %v, want %v", ok, seekable)
+				}
+			}
+
+			r, err := openHistory(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(r, test.name != "gzip")
+
+			// the bytes peeked from stdin are read again
+			stdin, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				w.Write(test.content)
+				w.Close()
+			}()
+			defer func(orig *os.File) { os.Stdin = orig }(os.Stdin)
+			os.Stdin = stdin
+			r, err = openHistory("-")
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(r, false)
+			stdin.Close()
+		})
+	}
+
+	path := filepath.Join(dir, "truncated")
+	if err := ioutil.WriteFile(path, compressed.Bytes()[:4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openHistory(path); err == nil {
+		t.Error("opened a truncated gzip header")
+	}
+}
+
+// Compressed histories can't be read twice, they are buffered while counting entries
+func TestImportGzip(t *testing.T) {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte("ls\nmake\n: 1600000000:0;git status\n"))
+	gz.Close()
+
+	for _, preserveOrder := range []bool{false, true} {
+		t.Run(fmt.Sprintf("preserve order %v", preserveOrder), func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "zsh"
+			cfg.PreserveOrder = preserveOrder
+			rows, _ := importHistories(t, cfg, compressed.String())
+			var started []int64
+			for _, row := range rows {
+				started = append(started, row.started)
+			}
+			want := []int64{testBaseTime.Unix(), testBaseTime.Unix(), 1600000000}
+			if preserveOrder {
+				want = []int64{testBaseTime.Unix() - 3, testBaseTime.Unix() - 2, 1600000000}
+			}
+			if got := commandsOf(rows); !reflect.DeepEqual(got, []string{"ls", "make", "git status"}) {
+				t.Errorf("commands = %q", got)
+			}
+			if !reflect.DeepEqual(started, want) {
+				t.Errorf("start times = %v, want %v", started, want)
+			}
+		})
+	}
+}
+
+func TestImportTimeUnit(t *testing.T) {
+	history := ": 1600000000:3;ls\nmake\n: 1600000001:0;git status\n: 1600000000:3;ls\n"
+	for _, size := range []int{1, 500} {
+		t.Run(fmt.Sprintf("batch=%d", size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.TimeUnit = "ms"
+			cfg.BatchSize = size
+			cfg.SkipExisting = true
+			addHistories(t, &cfg, history)
+
+			// the repeated entry is found in history or in the batch by its stored start time
+			stats, err := Import(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Inserted != 3 || stats.Existing != 1 {
+				t.Errorf("inserted %d and found %d existing entries, want 3 and 1", stats.Inserted, stats.Existing)
+			}
+			var got [][2]int64
+			for _, row := range queryHistory(t, db) {
+				got = append(got, [2]int64{row.started, row.duration})
+			}
+			// only the start time is scaled
+			want := [][2]int64{{1600000000000, 3}, {testBaseTime.Unix() * 1000, 0}, {1600000001000, 0}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("start times and durations = %v, want %v", got, want)
+			}
+
+			stats, err = Import(context.Background(), cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Inserted != 0 || stats.Existing != 4 {
+				t.Errorf("reimport inserted %d and found %d existing entries, want 0 and 4", stats.Inserted, stats.Existing)
+			}
+		})
+	}
+
+	_, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.TimeUnit = "us"
+	addHistories(t, &cfg, "ls\n")
+	if _, err := Import(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "Unknown time unit=us") {
+		t.Errorf("err = %v, want an unknown time unit", err)
+	}
+}
+
+func TestImportStrict(t *testing.T) {
+	tests := []struct {
+		entry    string
+		started  int64
+		duration int64
+		cmd      string
+		// rejected with Strict
+		invalid bool
+	}{
+		{": 1600000000:5;make", 1600000000, 5, "make", false},
+		{": 1600000000:abc;make", 1600000000, 0, "make", true},
+		{": 1600000000:-5;make", 1600000000, 0, "make", true},
+		{": 1600000000:1.5;make", 1600000000, 0, "make", true},
+		// not a timestamp prefix, the whole line is an untimed command
+		{": 16000x0000:5;make", testBaseTime.Unix(), 0, ": 16000x0000:5;make", false},
+	}
+	for i, test := range tests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.Format = "zsh"
+			rows, _ := importHistories(t, cfg, test.entry+"\n")
+			want := []historyRow{{0, 0, test.started, test.duration, test.cmd, "host", "/dir"}}
+			if !reflect.DeepEqual(rows, want) {
+				t.Errorf("history of %q = %v, want %v", test.entry, rows, want)
+			}
+
+			_, dsn := openTestDB(t)
+			cfg = testConfig(dsn)
+			cfg.Format = "zsh"
+			cfg.Strict = true
+			addHistories(t, &cfg, test.entry+"\n")
+			_, err := Import(context.Background(), cfg)
+			if test.invalid != (err != nil) {
+				t.Errorf("strict import of %q: %v, want an error %v", test.entry, err, test.invalid)
+			}
+		})
+	}
+}
+
+func TestImportBatchSize(t *testing.T) {
+	history := benchmarkHistory(6000, 6000)
+	for _, size := range []int{1, 500, maxBatchSize} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.BatchSize = size
+			rows, _ := importHistories(t, cfg, history)
+			if len(rows) != 6000 || rows[5999].argv != "make target5999" {
+				t.Errorf("imported %d rows", len(rows))
+			}
+		})
+	}
+
+	_, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.BatchSize = maxBatchSize + 1
+	addHistories(t, &cfg, history)
+	if _, err := Import(context.Background(), cfg); err == nil {
+		t.Errorf("imported with a batch size of %d", cfg.BatchSize)
+	}
+}
+
+func TestPrepareBatchError(t *testing.T) {
+	db, _ := openTestDB(t)
+	if err := ensureSchema(db, defaultTables, true); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := beginTransaction(context.Background(), db, txOptions{tables: defaultTables})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	// the statements of commands and places are prepared before the one of history fails
+	if _, err := tx.ExecContext(context.Background(), "DROP TABLE history;"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.prepareBatch(2); err == nil {
+		t.Error("prepared a batch without history table")
+	}
+}
+
+func TestImportPreserveOrderTwice(t *testing.T) {
+	// start times of untimed entries count down from BaseTime, and must be the same when imported again
+	for _, size := range []int{1, 500} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.Format = "plain"
+			cfg.PreserveOrder = true
+			cfg.BaseTime = time.Unix(1000, 0)
+			cfg.DedupHistory = true
+			cfg.BatchSize = size
+			addHistories(t, &cfg, "make\ngit status\nmake test\n")
+
+			for i := 0; i < 2; i++ {
+				if _, err := Import(context.Background(), cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want := []historyRow{
+				{0, 0, 997, 0, "make", "host", "/dir"},
+				{0, 0, 998, 0, "git status", "host", "/dir"},
+				{0, 0, 999, 0, "make test", "host", "/dir"},
+			}
+			if got := queryHistory(t, db); !reflect.DeepEqual(got, want) {
+				t.Errorf("history = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFollowOffsets(t *testing.T) {
+	db, dsn := openTestDB(t)
+	cfg := testConfig(dsn)
+	cfg.Format = "zsh"
+	addHistories(t, &cfg, ": 1600000000:0;make\n")
+	stats, err := Import(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// appended after the import read the history, before following it
+	path := cfg.HistoryFiles[0].File
+	if got, want := stats.Offsets, map[string]int64{path: 20}; !reflect.DeepEqual(got, want) {
+		t.Errorf("offsets = %v, want %v", got, want)
+	}
+	if err := ioutil.WriteFile(path, []byte(": 1600000000:0;make\n: 1600000001:0;make test\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := Follow(ctx, cfg, 10*time.Millisecond, stats.Offsets); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := commandsOf(queryHistory(t, db)), []string{"make", "make test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+}
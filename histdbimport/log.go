@@ -0,0 +1,51 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"errors"
+	"log"
+)
+
+// LogLevel controls which messages are logged during an import
+type LogLevel int
+
+const (
+	// LogDebug logs every inserted and skipped entry
+	LogDebug LogLevel = -1
+	// LogInfo logs progress and summaries
+	LogInfo LogLevel = 0
+	// LogError logs nothing, errors are returned to the caller
+	LogError LogLevel = 1
+)
+
+// ParseLogLevel parses a level name (debug, info, error)
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch level {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "error":
+		return LogError, nil
+	}
+	return LogInfo, errors.New("Unknown log level=" + level)
+}
+
+// writes messages through the standard logger when their level is enabled
+type logger struct {
+	level LogLevel
+}
+
+func (l logger) debugf(format string, v ...interface{}) {
+	if l.level <= LogDebug {
+		log.Printf(format, v...)
+	}
+}
+
+func (l logger) infof(format string, v ...interface{}) {
+	if l.level <= LogInfo {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,169 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+)
+
+// entries read ahead per parser goroutine
+const parseAheadSize = 256
+
+// raw entry read from the history and the result of parsing it, empty entries aren't parsed
+type pendingEntry struct {
+	raw      string
+	parsed   basicEntry
+	parseErr error
+	// error reading the history, ends it
+	readErr error
+	// closed once parsed
+	done chan struct{}
+	// timestamp given to the parser for entries without one
+	timestamp int64
+	// line of the history the entry starts on
+	line int64
+}
+
+// Counts the records consumed by the scanners of a history, lines unless records are NUL terminated
+type lineCounter struct {
+	sep   byte
+	lines int64
+}
+
+// Wraps split to count the records of the tokens it returns
+func (c *lineCounter) split(split bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := split(data, atEOF)
+		if advance > 0 && advance <= len(data) {
+			c.lines += int64(bytes.Count(data[:advance], []byte{c.sep}))
+		}
+		return advance, token, err
+	}
+}
+
+// Prefixes err with the file and line an entry starts on
+func errorAt(file string, line int64, err error) error {
+	return fmt.Errorf("%s, line %d: %v", displayName(file), line, err)
+}
+
+// Names file in messages, stdin for "-"
+func displayName(file string) string {
+	if file == "-" {
+		return "stdin"
+	}
+	return file
+}
+
+// Returns the next entry of scanner in history order, false once the history is read
+type entrySource func() (pendingEntry, bool)
+
+// Reads and parses entries one at a time, entries without timestamp get the current value of *timestamp
+func parseInline(scanner *bufio.Scanner, handler formatHandler, lines *lineCounter, timestamp *int64) entrySource {
+	return func() (pendingEntry, bool) {
+		line := lines.lines + 1
+		raw, ok, err := handler.read(scanner, nil)
+		if err == nil && !ok {
+			err = scanner.Err()
+		}
+		switch {
+		case err != nil:
+			return pendingEntry{readErr: err}, true
+		case !ok:
+			return pendingEntry{}, false
+		}
+
+		p := pendingEntry{raw: raw, timestamp: *timestamp, line: line}
+		if raw != "" {
+			p.parsed, p.parseErr = handler.parse(raw, p.timestamp)
+		}
+		return p, true
+	}
+}
+
+// Reads entries in a goroutine and parses them with a pool of parsers goroutines while the caller inserts,
+// entries are still returned in history order. Entries without timestamp are parsed with timestamp.
+// stop ends the goroutines, and must be called before scanner's reader is closed.
+func parseAhead(ctx context.Context, scanner *bufio.Scanner, handler formatHandler, lines *lineCounter, parsers int, timestamp int64) (next entrySource, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+
+	// entries are queued in order for the caller and handed to any parser
+	ordered := make(chan *pendingEntry, parsers*parseAheadSize)
+	jobs := make(chan *pendingEntry, parsers*parseAheadSize)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ordered)
+		defer close(jobs)
+
+		for {
+			// only this goroutine reads from scanner and counts its lines
+			line := lines.lines + 1
+			raw, ok, err := handler.read(scanner, nil)
+			if err == nil && !ok {
+				err = scanner.Err()
+			}
+			if err != nil {
+				done := make(chan struct{})
+				close(done)
+				select {
+				case ordered <- &pendingEntry{readErr: err, done: done}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if !ok {
+				return
+			}
+
+			p := &pendingEntry{raw: raw, done: make(chan struct{}), timestamp: timestamp, line: line}
+			select {
+			case ordered <- p:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wg.Add(parsers)
+	for i := 0; i < parsers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				if p.raw != "" {
+					p.parsed, p.parseErr = handler.parse(p.raw, p.timestamp)
+				}
+				close(p.done)
+			}
+		}()
+	}
+
+	next = func() (pendingEntry, bool) {
+		p, ok := <-ordered
+		if !ok {
+			return pendingEntry{}, false
+		}
+		select {
+		case <-p.done:
+			return *p, true
+		case <-ctx.Done():
+			return pendingEntry{readErr: ctx.Err()}, true
+		}
+	}
+	stop = func() {
+		cancel()
+		wg.Wait()
+	}
+	return next, stop
+}
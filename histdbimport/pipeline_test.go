@@ -0,0 +1,96 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns a history of n entries in format, mixing entries with and without timestamp and multi-line ones
+// where the format has them
+func pipelineHistory(format string, n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		started := 1600000000 + i
+		switch format {
+		case "zsh":
+			switch i % 3 {
+			case 0:
+				fmt.Fprintf(&b, ": %d:%d;make target%d\n", started, i%5, i)
+			case 1:
+				fmt.Fprintf(&b, "untimed %d\n", i)
+			case 2:
+				fmt.Fprintf(&b, ": %d:0;echo %d\\\nline\n", started, i)
+			}
+		case "bash":
+			if i%2 == 0 {
+				fmt.Fprintf(&b, "#%d\n", started)
+			}
+			fmt.Fprintf(&b, "make target%d\n", i)
+		case "fish":
+			fmt.Fprintf(&b, "- cmd: make target%d\n  when: %d\n", i, started)
+		case "psreadline":
+			if i%4 == 0 {
+				fmt.Fprintf(&b, "echo %d`\nline\n", i)
+			} else {
+				fmt.Fprintf(&b, "make target%d\n", i)
+			}
+		case "json":
+			if i%2 == 0 {
+				fmt.Fprintf(&b, "{\"cmd\": \"make target%d\", \"started\": %d, \"duration\": %d}\n", i, started, i%5)
+			} else {
+				fmt.Fprintf(&b, "{\"cmd\": \"make target%d\"}\n", i)
+			}
+		case "histdb-tsv":
+			fmt.Fprintf(&b, "%d\thost%d\t/dir\t%d\t%d\t0\tmake\\ttarget%d\n", i%3, i%2, i%2, started, i)
+		default:
+			fmt.Fprintf(&b, "make target%d\n", i)
+		}
+	}
+	return b.String()
+}
+
+// Entries parsed ahead by several goroutines are imported like entries parsed one at a time while inserting,
+// run with -race to check the pipeline
+func TestImportParsers(t *testing.T) {
+	formats := []string{"zsh", "bash", "fish", "plain", "bash-plain", "psreadline", "json", "histdb-tsv"}
+	modes := []struct {
+		name      string
+		configure func(cfg *Config)
+	}{
+		{"default", func(cfg *Config) {}},
+		{"preserve-order", func(cfg *Config) { cfg.PreserveOrder = true }},
+		{"tail", func(cfg *Config) { cfg.Tail = 100 }},
+		{"preserve-order tail batch=1", func(cfg *Config) { cfg.PreserveOrder, cfg.Tail, cfg.BatchSize = true, 100, 1 }},
+	}
+	for _, format := range formats {
+		history := pipelineHistory(format, 1000)
+		for _, mode := range modes {
+			t.Run(format+"/"+mode.name, func(t *testing.T) {
+				var rows [2][]historyRow
+				var stats [2]Stats
+				for i, parsers := range []int{1, 4} {
+					cfg := testConfig("")
+					cfg.Format = format
+					cfg.Parsers = parsers
+					mode.configure(&cfg)
+					rows[i], stats[i] = importHistories(t, cfg, history)
+				}
+				if len(rows[0]) == 0 {
+					t.Fatal("nothing imported")
+				}
+				if !reflect.DeepEqual(rows[1], rows[0]) {
+					t.Errorf("history parsed ahead differs, %d rows instead of %d", len(rows[1]), len(rows[0]))
+				}
+				stats[0].Offsets, stats[1].Offsets = nil, nil
+				if !reflect.DeepEqual(stats[1], stats[0]) {
+					t.Errorf("stats parsed ahead = %+v, want %+v", stats[1], stats[0])
+				}
+			})
+		}
+	}
+}
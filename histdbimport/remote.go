@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// IsRemote reports whether file is a history file on another machine, given as ssh://[user@]host[:port]/path
+// or scp://[user@]host[:port]/path, paths starting with /~/ are relative to the remote home directory
+func IsRemote(file string) bool {
+	return strings.HasPrefix(file, "ssh://") || strings.HasPrefix(file, "scp://")
+}
+
+// Copies the remote history file to a temporary file with the ssh client, so it can be read twice when preserving order,
+// returning its path. The caller removes it
+func fetchRemote(ctx context.Context, file string, lg logger) (string, error) {
+	args, err := sshArgs(file)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile("", "histdbimport-*")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+
+	lg.infof("Fetching %s\n", file)
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	// password and host key prompts go through the terminal
+	cmd.Stdout, cmd.Stderr = tmp, os.Stderr
+	err = cmd.Run()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", errors.New("Unable to fetch " + file + ": " + err.Error())
+	}
+	return tmp.Name(), nil
+}
+
+// Returns the arguments of the ssh client printing the remote history file
+func sshArgs(file string) ([]string, error) {
+	u, err := url.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" || u.Path == "" || u.Path == "/" {
+		return nil, errors.New("Invalid remote history=" + file + ", expected ssh://[user@]host[:port]/path")
+	}
+
+	args := []string{}
+	if u.Port() != "" {
+		args = append(args, "-p", u.Port())
+	}
+	dest := u.Hostname()
+	if u.User != nil {
+		dest = u.User.Username() + "@" + dest
+	}
+	return append(args, "--", dest, "cat -- "+remotePath(u.Path)), nil
+}
+
+// Quotes path for the remote shell, leaving a leading ~/ to be expanded
+func remotePath(path string) string {
+	prefix := ""
+	if strings.HasPrefix(path, "/~/") {
+		prefix, path = "~/", path[len("/~/"):]
+	}
+	return prefix + "'" + strings.Replace(path, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+)
+
+func TestSSHArgs(t *testing.T) {
+	tests := []struct {
+		file string
+		want []string
+	}{
+		{"ssh://host/home/alice/.zsh_history", []string{"--", "host", "cat -- '/home/alice/.zsh_history'"}},
+		{"scp://host/home/alice/.zsh_history", []string{"--", "host", "cat -- '/home/alice/.zsh_history'"}},
+		{"ssh://alice@host:2222/var/h", []string{"-p", "2222", "--", "alice@host", "cat -- '/var/h'"}},
+		{"ssh://alice@[::1]:22/var/h", []string{"-p", "22", "--", "alice@::1", "cat -- '/var/h'"}},
+		// relative to the remote home directory
+		{"ssh://host/~/.zsh_history", []string{"--", "host", "cat -- ~/'.zsh_history'"}},
+		{"ssh://host/~/it's here", []string{"--", "host", `cat -- ~/'it'\''s here'`}},
+		{"ssh://host/tmp/$(rm -rf ~)", []string{"--", "host", "cat -- '/tmp/$(rm -rf ~)'"}},
+		{"ssh://host/tmp/a%20b", []string{"--", "host", "cat -- '/tmp/a b'"}},
+		// a user or host starting with - isn't taken as an option of ssh
+		{"ssh://-oProxyCommand=x@host/h", []string{"--", "-oProxyCommand=x@host", "cat -- '/h'"}},
+	}
+	for _, test := range tests {
+		got, err := sshArgs(test.file)
+		if err != nil {
+			t.Errorf("sshArgs(%q): %v", test.file, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("sshArgs(%q) = %q, want %q", test.file, got, test.want)
+		}
+	}
+
+	for _, file := range []string{"ssh://host", "ssh://host/", "ssh:///h", "ssh://host:port/h"} {
+		if got, err := sshArgs(file); err == nil {
+			t.Errorf("sshArgs(%q) = %q, want an error", file, got)
+		}
+	}
+}
+
+// The quoted path is read back unchanged by a shell
+func TestRemotePath(t *testing.T) {
+	for _, path := range []string{"/h", "/it's", "/a b/'c'", `/$HOME/\n`, "/``"} {
+		out, err := exec.Command("sh", "-c", "printf '%s' "+remotePath(path)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != path {
+			t.Errorf("remotePath(%q) is read as %q", path, out)
+		}
+	}
+	out, err := exec.Command("sh", "-c", "HOME=/home/alice; printf '%s' "+remotePath("/~/it's")).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/home/alice/it's"; string(out) != want {
+		t.Errorf("remotePath(%q) is read as %q, want %q", "/~/it's", out, want)
+	}
+}
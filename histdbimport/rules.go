@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rule skips or sets the exit status of the entries whose command matches Pattern
+type Rule struct {
+	Pattern *regexp.Regexp
+	// skip matching entries like ignored commands
+	Skip bool
+	// exit_status of matching entries unless Skip
+	ExitStatus int
+}
+
+// ParseRules reads one rule per line, "<regexp> -> skip" or "<regexp> -> <exit status>",
+// blank lines and lines starting with # are ignored
+func ParseRules(r io.Reader) (rules []Rule, err error) {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		i := strings.LastIndex(text, "->")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid rule on line %d, expected <regexp> -> skip|<exit status>: %s", line, text)
+		}
+		pattern, action := strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:])
+
+		rule := Rule{}
+		rule.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid rule pattern on line %d: %v", line, err)
+		}
+		if action == "skip" {
+			rule.Skip = true
+		} else if rule.ExitStatus, err = strconv.Atoi(action); err != nil {
+			return nil, fmt.Errorf("Invalid rule action on line %d, expected skip or an exit status: %s", line, action)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, scanner.Err()
+}
+
+// Returns the first rule matching cmd, nil if none does
+func (cfg *Config) rule(cmd string) *Rule {
+	for i := range cfg.Rules {
+		if cfg.Rules[i].Pattern.MatchString(cmd) {
+			return &cfg.Rules[i]
+		}
+	}
+	return nil
+}
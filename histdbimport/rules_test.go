@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	// patterns, skips and exit statuses of the rules
+	type rule struct {
+		pattern    string
+		skip       bool
+		exitStatus int
+	}
+	tests := []struct {
+		name  string
+		rules string
+		want  []rule
+		// error the rules fail with
+		err string
+	}{
+		{"skip", "^ls\\b -> skip", []rule{{`^ls\b`, true, 0}}, ""},
+		{"exit status", "^false$ -> 1\n^make -> -2", []rule{{"^false$", false, 1}, {"^make", false, -2}}, ""},
+		{"spaces", "  ^git  push   ->  128  ", []rule{{"^git  push", false, 128}}, ""},
+		// the last arrow separates the action, patterns may contain arrows
+		{"arrow in pattern", "a -> b -> skip", []rule{{"a -> b", true, 0}}, ""},
+		{"comments and blank lines", "# exit statuses\n\n   \n  # indented\n^x -> 2\n", []rule{{"^x", false, 2}}, ""},
+		{"none", "", nil, ""},
+		{"missing arrow", "^ls\n", nil, "Invalid rule on line 1"},
+		{"bad action", "# comment\n\n^ls -> ignore\n", nil, "Invalid rule action on line 3"},
+		{"fractional exit status", "^ls -> 1.5\n", nil, "Invalid rule action on line 1"},
+		{"bad regexp", "^ls -> skip\n([a -> 1\n", nil, "Invalid rule pattern on line 2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(test.rules))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []rule
+			for _, r := range rules {
+				got = append(got, rule{r.Pattern.String(), r.Skip, r.ExitStatus})
+			}
+			if len(got) != len(test.want) {
+				t.Fatalf("rules = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("rule %d = %v, want %v", i, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
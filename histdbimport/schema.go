@@ -0,0 +1,293 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// histdb schema, as created by zsh-histdb, with table names to expand; its indexes are listed by schemaIndexes
+const schema = `
+	CREATE TABLE {commands} (id integer primary key autoincrement, argv text, unique(argv) on conflict ignore);
+	CREATE TABLE {places}   (id integer primary key autoincrement, host text, dir text, unique(host, dir) on conflict ignore);
+	CREATE TABLE {history}  (id integer primary key autoincrement,
+	                       session int,
+	                       command_id int references {commands} (id),
+	                       place_id int references {places} (id),
+	                       exit_status int,
+	                       start_time int,
+	                       duration int);
+	PRAGMA user_version = 2;
+`
+
+// tables making up the histdb schema
+var schemaTables = []string{"{commands}", "{places}", "{history}"}
+
+// names of the histdb tables, substituted for {commands}, {places} and {history} in queries
+type tableNames struct {
+	commands, places, history string
+}
+
+// names of the tables created by zsh-histdb
+var defaultTables = tableNames{"commands", "places", "history"}
+
+// table names are interpolated into queries, only plain identifiers are accepted
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Returns the table names set in cfg, the histdb ones if empty
+func (cfg *Config) tables() (tableNames, error) {
+	tables := defaultTables
+	for _, t := range []struct {
+		name  *string
+		value string
+	}{
+		{&tables.commands, cfg.CommandsTable},
+		{&tables.places, cfg.PlacesTable},
+		{&tables.history, cfg.HistoryTable},
+	} {
+		if t.value == "" {
+			continue
+		}
+		if !validTableName.MatchString(t.value) {
+			return tableNames{}, errors.New("Invalid table name=" + t.value + ", only letters, digits and underscores are allowed")
+		}
+		*t.name = t.value
+	}
+	return tables, nil
+}
+
+// Replaces {commands}, {places} and {history} in query by the table names
+func (tables tableNames) expand(query string) string {
+	return strings.NewReplacer("{commands}", tables.commands, "{places}", tables.places, "{history}", tables.history).Replace(query)
+}
+
+// Returns the name of an index of the schema, prefixed by the history table when the tables aren't the histdb ones
+// so the indexes of several histories in a database don't clash
+func (tables tableNames) indexName(name string) string {
+	if tables == defaultTables {
+		return name
+	}
+	return tables.history + "_" + name
+}
+
+// columns of the histdb schema used by the import
+var schemaColumns = []struct {
+	table   string
+	columns []string
+}{
+	{"{commands}", []string{"argv"}},
+	{"{places}", []string{"host", "dir"}},
+	{"{history}", []string{"session", "command_id", "place_id", "exit_status", "start_time", "duration"}},
+}
+
+// indexes histdb creates to speed up its queries, the unique ones are checked by checkUniqueIndexes
+var schemaIndexes = []struct {
+	name    string
+	table   string
+	columns []string
+}{
+	{"hist_time", "{history}", []string{"start_time"}},
+	{"place_dir", "{places}", []string{"dir"}},
+	{"place_host", "{places}", []string{"host"}},
+	{"history_command_place", "{history}", []string{"command_id", "place_id"}},
+}
+
+// Copies the schema of the template database (tables, indexes, views, triggers and user_version) into db if it has
+// no schema at all, e.g. a new file, so it matches the histdb version that created the template. Rows aren't copied
+func copySchema(db *sql.DB, template string, lg logger) error {
+	var objects int
+	err := db.QueryRow("SELECT count(*) FROM sqlite_master;").Scan(&objects)
+	if err != nil || objects > 0 {
+		return err
+	}
+	if _, err := os.Stat(template); os.IsNotExist(err) {
+		return errors.New("Template database doesn't exist=" + template)
+	} else if err != nil {
+		return err
+	}
+
+	src, err := sql.Open("sqlite3", "file:"+(&url.URL{Path: template}).EscapedPath()+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// tables first so indexes, views and triggers can refer to them
+	ddl, err := queryStrings(src, `SELECT sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%'
+		ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 WHEN 'view' THEN 2 ELSE 3 END, rowid;`)
+	if err != nil {
+		return fmt.Errorf("Unable to read template database %s: %v", template, err)
+	}
+	if len(ddl) == 0 {
+		return errors.New("Template database has no schema=" + template)
+	}
+	var version int
+	err = src.QueryRow("PRAGMA user_version;").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	lg.infof("Copying the schema of %s\n", template)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range append(ddl, fmt.Sprintf("PRAGMA user_version = %d", version)) {
+		_, err = tx.Exec(stmt + ";")
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Creates the histdb schema if create is set and the database has none of its tables,
+// a database with only some of the tables is never altered
+func ensureSchema(db *sql.DB, tables tableNames, create bool) error {
+	var missing []string
+	for _, table := range schemaTables {
+		table = tables.expand(table)
+		var exists bool
+		err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?);", table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			missing = append(missing, table)
+		}
+	}
+
+	switch {
+	case len(missing) == 0:
+		return nil
+	case len(missing) < len(schemaTables):
+		return fmt.Errorf("Database has a partial histdb schema, missing tables: %s", strings.Join(missing, ", "))
+	case !create:
+		return errors.New("Database has no histdb tables, enable schema creation (-create-schema) to create them")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(tables.expand(schema))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, index := range schemaIndexes {
+		_, err = tx.Exec(fmt.Sprintf("CREATE INDEX %s ON %s(%s);",
+			tables.indexName(index.name), tables.expand(index.table), strings.Join(index.columns, ", ")))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Checks that the histdb tables have the columns used by the import, listing every missing one
+func checkColumns(db *sql.DB, tables tableNames) error {
+	var missing []string
+	for _, c := range schemaColumns {
+		table := tables.expand(c.table)
+		columns, err := queryStrings(db, "SELECT name FROM pragma_table_info(?);", table)
+		if err != nil {
+			return err
+		}
+
+	required:
+		for _, required := range c.columns {
+			for _, column := range columns {
+				if column == required {
+					continue required
+				}
+			}
+			missing = append(missing, table+"."+required)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("Database schema doesn't match histdb, missing columns: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Adds the raw column holding the source line of entries to history if missing and create is set
+func ensureRawColumn(db *sql.DB, tables tableNames, create bool, lg logger) error {
+	columns, err := queryStrings(db, "SELECT name FROM pragma_table_info(?);", tables.history)
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		if column == "raw" {
+			return nil
+		}
+	}
+	if !create {
+		return errors.New("Table " + tables.history + " has no raw column to store entries in, enable schema creation (-create-schema) to add it")
+	}
+
+	lg.infof("Adding column raw to %s\n", tables.history)
+	_, err = db.Exec(tables.expand("ALTER TABLE {history} ADD COLUMN raw text;"))
+	return err
+}
+
+// unique index making history inserts ignore rows already present, created by ensureHistoryUnique
+const historyUniqueIndex = "histdbimport_history_unique"
+
+// Creates the unique index over the columns identifying a history row if missing,
+// fails if the history already has duplicate rows
+func ensureHistoryUnique(db *sql.DB, tables tableNames, lg logger) error {
+	columns := []string{"session", "command_id", "place_id", "start_time"}
+	ok, err := hasIndex(db, true, tables.history, columns...)
+	if err != nil || ok {
+		return err
+	}
+
+	name := tables.indexName(historyUniqueIndex)
+	lg.infof("Creating unique index %s on %s(%s)\n", name, tables.history, strings.Join(columns, ", "))
+	_, err = db.Exec(fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s(%s);", name, tables.history, strings.Join(columns, ", ")))
+	if err != nil {
+		return fmt.Errorf("Unable to create unique index on %s, it may have duplicate rows: %v", tables.history, err)
+	}
+	return nil
+}
+
+// Creates the histdb indexes missing from the database if create is set, otherwise warns about them
+func checkIndexes(db *sql.DB, tables tableNames, create bool, lg logger) error {
+	for _, index := range schemaIndexes {
+		table, name := tables.expand(index.table), tables.indexName(index.name)
+		ok, err := hasIndex(db, false, table, index.columns...)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+
+		if !create {
+			lg.infof("Warning: missing index on %s(%s), histdb queries may be slow, use -create-indexes to create it\n",
+				table, strings.Join(index.columns, ", "))
+			continue
+		}
+
+		lg.infof("Creating index %s on %s(%s)\n", name, table, strings.Join(index.columns, ", "))
+		_, err = db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s);",
+			name, table, strings.Join(index.columns, ", ")))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,147 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Histories kept under other table names live next to the histdb ones, every query uses the configured names
+func TestImportTableNames(t *testing.T) {
+	history := ": 1600000000:0;ls\n: 1600000001:0;make\n: 1600000001:0;make\n: 1600000002:0;ls\n"
+	for _, size := range []int{1, 500} {
+		t.Run(fmt.Sprintf("batch=%d", size), func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			imp := func(configure func(cfg *Config)) Stats {
+				t.Helper()
+				cfg := testConfig(dsn)
+				cfg.Format = "zsh"
+				cfg.BatchSize = size
+				cfg.SkipExisting = true
+				configure(&cfg)
+				addHistories(t, &cfg, history)
+				stats, err := Import(context.Background(), cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return stats
+			}
+			renamed := func(cfg *Config) {
+				cfg.CommandsTable, cfg.PlacesTable, cfg.HistoryTable = "work_commands", "work_places", "work_history"
+			}
+
+			imp(func(cfg *Config) {})
+			if stats := imp(renamed); stats.Inserted != 3 {
+				t.Errorf("inserted %d entries in the renamed tables, want 3", stats.Inserted)
+			}
+			// existing entries are looked up in the renamed tables
+			if stats := imp(renamed); stats.Inserted != 0 || stats.Existing != 4 {
+				t.Errorf("reimport inserted %d and found %d existing entries, want 0 and 4", stats.Inserted, stats.Existing)
+			}
+
+			if got := commandsOf(queryHistory(t, db)); !reflect.DeepEqual(got, []string{"ls", "make", "ls"}) {
+				t.Errorf("histdb commands = %q", got)
+			}
+			got := mustQueryStrings(t, db, `
+				SELECT argv FROM work_history
+				JOIN work_commands ON work_commands.id = work_history.command_id
+				JOIN work_places ON work_places.id = work_history.place_id
+				ORDER BY work_history.id;
+			`)
+			if want := []string{"ls", "make", "ls"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("renamed commands = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestTablesInvalid(t *testing.T) {
+	for _, name := range []string{"1history", "history;DROP TABLE commands", "work-history", "main.history", `"history"`} {
+		t.Run(name, func(t *testing.T) {
+			cfg := testConfig("")
+			cfg.HistoryTable = name
+			if _, err := cfg.tables(); err == nil || !strings.Contains(err.Error(), "Invalid table name="+name) {
+				t.Errorf("err = %v, want an invalid table name", err)
+			}
+		})
+	}
+}
+
+// The whole schema of the template is copied into a new database, views and triggers included, but not its rows
+func TestImportTemplateDatabase(t *testing.T) {
+	dir := t.TempDir()
+	template := filepath.Join(dir, "template.db")
+	src, err := sql.Open("sqlite3", template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		defaultTables.expand(schema),
+		"CREATE INDEX hist_time ON history (start_time);",
+		"CREATE TABLE imported (history_id int);",
+		"CREATE VIEW commands_run AS SELECT argv, start_time FROM history JOIN commands ON commands.id = command_id;",
+		"CREATE TRIGGER history_imported AFTER INSERT ON history BEGIN INSERT INTO imported VALUES (new.id); END;",
+		"INSERT INTO commands (argv) VALUES ('template');",
+		"PRAGMA user_version = 3;",
+	} {
+		if _, err := src.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src.Close()
+
+	dst := filepath.Join(dir, "history.db")
+	cfg := testConfig("")
+	cfg.DatabaseFile = dst
+	cfg.CreateSchema = false
+	cfg.TemplateDatabase = template
+	cfg.Format = "zsh"
+	addHistories(t, &cfg, ": 1600000000:0;ls\n: 1600000001:0;make\n")
+	// the second import finds the schema and leaves it alone
+	for i := 0; i < 2; i++ {
+		if _, err := Import(context.Background(), cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	got := mustQueryStrings(t, db, "SELECT type || ' ' || name FROM sqlite_master WHERE name NOT LIKE 'sqlite_%' ORDER BY type, name;")
+	want := []string{
+		"index hist_time",
+		"table commands", "table history", "table imported", "table places",
+		"trigger history_imported",
+		"view commands_run",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("schema = %q, want %q", got, want)
+	}
+	if got := mustQueryStrings(t, db, "PRAGMA user_version;"); !reflect.DeepEqual(got, []string{"3"}) {
+		t.Errorf("user_version = %v, want 3", got)
+	}
+	if got, want := mustQueryStrings(t, db, "SELECT argv FROM commands_run ORDER BY start_time;"), []string{"ls", "ls", "make", "make"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands = %q, want %q", got, want)
+	}
+	if got, want := mustQueryStrings(t, db, "SELECT argv FROM commands ORDER BY id;"), []string{"ls", "make"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("commands table = %q, want %q", got, want)
+	}
+	if got := mustQueryStrings(t, db, "SELECT count(*) FROM imported;"); !reflect.DeepEqual(got, []string{"4"}) {
+		t.Errorf("rows inserted by the trigger = %v, want 4", got)
+	}
+
+	cfg.DatabaseFile = filepath.Join(dir, "missing.db")
+	cfg.TemplateDatabase = filepath.Join(dir, "missing-template.db")
+	if _, err := Import(context.Background(), cfg); err == nil || !strings.Contains(err.Error(), "Template database doesn't exist") {
+		t.Errorf("err = %v, want a missing template", err)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build cgo
+// +build cgo
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+// SQLite errors and connections are only defined by go-sqlite3 when built with cgo, see sqlite_nocgo.go
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Reports whether err is SQLite failing because another connection locks the database
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
+
+// Reports whether err is SQLite unable to read the database, not SQLite or encrypted with another key
+func isNotADB(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrNotADB
+}
+
+// Runs pragmas on a connection from the connect hook of the driver
+func execPragmas(conn *sqlite3.SQLiteConn, pragmas []string) error {
+	for _, pragma := range pragmas {
+		if _, err := conn.Exec(pragma, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fails unless the SQLite linked is SQLCipher, which would otherwise ignore the key pragma and read the database as plain.
+// An in-memory database is asked since statements on an encrypted file fail before they run
+func checkCipher(drv *sqlite3.SQLiteDriver) error {
+	conn, err := drv.Open(":memory:")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rows, err := conn.(*sqlite3.SQLiteConn).Query("PRAGMA cipher_version;", nil)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	err = rows.Next(make([]driver.Value, len(rows.Columns())))
+	if err == io.EOF {
+		return errors.New("SQLite isn't built with SQLCipher, build with the libsqlite3 tag against SQLCipher to use a key (-key)")
+	}
+	return err
+}
@@ -0,0 +1,32 @@
+//go:build !cgo
+// +build !cgo
+
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+// go-sqlite3 built without cgo is a stub failing to open any database, nothing it returns is an SQLite error
+
+import "github.com/mattn/go-sqlite3"
+
+// Reports whether err is SQLite failing because another connection locks the database
+func isBusy(err error) bool {
+	return false
+}
+
+// Reports whether err is SQLite unable to read the database, not SQLite or encrypted with another key
+func isNotADB(err error) bool {
+	return false
+}
+
+// Runs pragmas on a connection from the connect hook of the driver, which the stub never calls
+func execPragmas(conn *sqlite3.SQLiteConn, pragmas []string) error {
+	return nil
+}
+
+// Fails with the error of the stub driver
+func checkCipher(drv *sqlite3.SQLiteDriver) error {
+	_, err := drv.Open(":memory:")
+	return err
+}
@@ -0,0 +1,68 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Summary describes the entries an import would insert
+type Summary struct {
+	// what would happen to the entries, as reported by a dry run
+	Stats
+	// number of distinct commands, hosts and dirs
+	Commands int
+	Hosts    int
+	Dirs     int
+	// earliest and latest start times, zero if no entry has a timestamp
+	First time.Time
+	Last  time.Time
+}
+
+func (s Summary) String() string {
+	span := "no timestamps"
+	if !s.First.IsZero() {
+		span = s.First.Format(time.RFC3339) + " - " + s.Last.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%s commands=%d hosts=%d dirs=%d span=%s",
+		s.Stats, s.Commands, s.Hosts, s.Dirs, span)
+}
+
+// Summarize parses the history files described by cfg like a dry run and describes the entries that would be inserted
+func Summarize(ctx context.Context, cfg Config) (summary Summary, err error) {
+	if cfg.Format == "" {
+		cfg.Format = "zsh"
+	}
+
+	var (
+		commands = map[string]bool{}
+		hosts    = map[string]bool{}
+		dirs     = map[string]bool{}
+	)
+	cfg.visit = func(entry basicEntry) {
+		commands[entry.cmd] = true
+		hosts[entry.host] = true
+		dirs[entry.dir] = true
+
+		// synthesized timestamps are the import time, they don't tell when the history was recorded
+		started, err := strconv.ParseInt(entry.started, 10, 64)
+		if entry.synthesized || err != nil {
+			return
+		}
+		t := time.Unix(started, 0)
+		if summary.First.IsZero() || t.Before(summary.First) {
+			summary.First = t
+		}
+		if summary.Last.IsZero() || t.After(summary.Last) {
+			summary.Last = t
+		}
+	}
+
+	summary.Stats, err = readSources(ctx, cfg, nil, cfg.sources())
+	summary.Commands, summary.Hosts, summary.Dirs = len(commands), len(hosts), len(dirs)
+	return summary, err
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// entries handled per second, logged every interval by a goroutine of its own until stopped
+type throughput struct {
+	// accessed atomically, first for alignment on 32-bit platforms
+	done  int64
+	total int64
+
+	log     logger
+	start   time.Time
+	stopped chan struct{}
+	exited  chan struct{}
+}
+
+// Starts logging the throughput of file every interval, nothing is logged if interval is 0
+func startThroughput(lg logger, file string, interval time.Duration, total int64) *throughput {
+	t := &throughput{total: total, log: lg, start: time.Now(), stopped: make(chan struct{}), exited: make(chan struct{})}
+	if interval <= 0 {
+		close(t.exited)
+		return t
+	}
+
+	go func() {
+		defer close(t.exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		var last int64
+		lastTick := t.start
+		for {
+			select {
+			case <-t.stopped:
+				return
+			case now := <-ticker.C:
+				done := atomic.LoadInt64(&t.done)
+				t.report(file, now, done, float64(done-last)/now.Sub(lastTick).Seconds())
+				last, lastTick = done, now
+			}
+		}
+	}()
+	return t
+}
+
+// Counts an entry inserted or skipped as existing
+func (t *throughput) add() {
+	atomic.AddInt64(&t.done, 1)
+}
+
+// Logs the entries handled so far and their rate, the remaining time is estimated when the total is known
+func (t *throughput) report(file string, now time.Time, done int64, recent float64) {
+	elapsed := now.Sub(t.start)
+	rate := float64(done) / elapsed.Seconds()
+	if t.total > 0 && rate > 0 {
+		remaining := time.Duration(float64(t.total-done) / rate * float64(time.Second))
+		t.log.infof("%s: %d/%d entries in %s, %.0f entries/s (%.0f/s recently), about %s remaining\n",
+			file, done, t.total, elapsed.Round(time.Second), rate, recent, remaining.Round(time.Second))
+		return
+	}
+	t.log.infof("%s: %d entries in %s, %.0f entries/s (%.0f/s recently)\n", file, done, elapsed.Round(time.Second), rate, recent)
+}
+
+// Stops logging, once stop returns nothing more is logged
+func (t *throughput) stop() {
+	select {
+	case <-t.exited:
+	default:
+		close(t.stopped)
+		<-t.exited
+	}
+}
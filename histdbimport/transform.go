@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// rewrites commands with the external program of TransformCommand
+type transformer interface {
+	// Returns cmd as rewritten by the program, failing entries return an errTransform
+	transform(cmd string) (string, error)
+	close() error
+}
+
+// error of the program on a single entry, the entry can be skipped
+type errTransform struct {
+	err error
+}
+
+func (e errTransform) Error() string {
+	return e.err.Error()
+}
+
+// Starts the transformer described by cfg, nil without TransformCommand
+func (cfg *Config) newTransformer(ctx context.Context) (transformer, error) {
+	switch {
+	case cfg.TransformCommand == "":
+		return nil, nil
+	case cfg.TransformPersistent:
+		timeout := cfg.TransformTimeout
+		if timeout <= 0 {
+			timeout = defaultTransformTimeout
+		}
+		return startPersistentTransform(ctx, cfg.TransformCommand, timeout)
+	}
+	return entryTransform{ctx, cfg.TransformCommand}, nil
+}
+
+// runs the program once per command, given on stdin, and reads the command from stdout
+type entryTransform struct {
+	ctx     context.Context
+	program string
+}
+
+func (t entryTransform) transform(cmd string) (string, error) {
+	c := exec.CommandContext(t.ctx, "sh", "-c", t.program)
+	c.Stdin = strings.NewReader(cmd)
+	var stderr bytes.Buffer
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		if t.ctx.Err() != nil {
+			return "", t.ctx.Err()
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = errTransform{fmt.Errorf("Transform command failed with %v: %s", err, strings.TrimSpace(stderr.String()))}
+		}
+		return "", err
+	}
+	// like command substitution, the newline ending the output isn't part of the command
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func (t entryTransform) close() error {
+	return nil
+}
+
+// how long the persistent program may take to answer a command, see Config.TransformTimeout
+const defaultTransformTimeout = 10 * time.Second
+
+// keeps the program running, commands are written to its stdin and read from its stdout as NUL terminated records.
+// A program buffering its output never answers, the pipes time out after timeout instead of waiting for it
+type persistentTransform struct {
+	cmd     *exec.Cmd
+	in      *os.File
+	outFile *os.File
+	out     *bufio.Reader
+	timeout time.Duration
+}
+
+func startPersistentTransform(ctx context.Context, program string, timeout time.Duration) (_ *persistentTransform, err error) {
+	c := exec.CommandContext(ctx, "sh", "-c", program)
+	c.Stderr = os.Stderr
+	// pipes of our own, unlike those of StdinPipe and StdoutPipe they have deadlines
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		return nil, err
+	}
+	// the ends of the program are only kept open by it
+	defer inR.Close()
+	defer outW.Close()
+	defer func() {
+		if err != nil {
+			inW.Close()
+			outR.Close()
+		}
+	}()
+
+	c.Stdin, c.Stdout = inR, outW
+	if err = c.Start(); err != nil {
+		return nil, err
+	}
+	return &persistentTransform{c, inW, outR, bufio.NewReader(outR), timeout}, nil
+}
+
+// Fails if the program exits or doesn't answer in time, no later command could be transformed
+func (t *persistentTransform) transform(cmd string) (string, error) {
+	deadline := time.Now().Add(t.timeout)
+	t.in.SetWriteDeadline(deadline)
+	if _, err := io.WriteString(t.in, cmd+"\x00"); err != nil {
+		return "", t.exited(err)
+	}
+	t.outFile.SetReadDeadline(deadline)
+	out, err := t.out.ReadString(0)
+	if err != nil {
+		return "", t.exited(err)
+	}
+	return strings.TrimSuffix(out, "\x00"), nil
+}
+
+// Returns why the program stopped answering, its exit status if it exited
+func (t *persistentTransform) exited(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.cmd.Process.Kill()
+		t.close()
+		return fmt.Errorf("Transform command didn't answer within %s, it must write each command without buffering its output", t.timeout)
+	}
+	if waitErr := t.close(); waitErr != nil {
+		err = waitErr
+	}
+	return fmt.Errorf("Transform command stopped: %v", err)
+}
+
+func (t *persistentTransform) close() error {
+	t.in.Close()
+	defer t.outFile.Close()
+	if t.cmd.ProcessState != nil {
+		return nil
+	}
+	return t.cmd.Wait()
+}
@@ -0,0 +1,64 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImportTransform(t *testing.T) {
+	history := ": 1600000000:0;make\n: 1600000001:0;echo secret\n: 1600000002:0;fail now\n: 1600000003:0;git push\n"
+	// fails on commands starting with fail, drops those holding secret
+	const failing = `c=$(cat); case "$c" in fail*) echo failed >&2; exit 3;; *secret*) exit 0;; esac; printf '%s' "$c"`
+	tests := []struct {
+		name       string
+		program    string
+		persistent bool
+		skipErrors bool
+		want       []string
+		// error the import fails with
+		err                  string
+		ignored, parseErrors int
+	}{
+		{"per entry", "tr a-z A-Z", false, false, []string{"MAKE", "ECHO SECRET", "FAIL NOW", "GIT PUSH"}, "", 0, 0},
+		{"empty output", "sed '/secret/d'", false, false, []string{"make", "fail now", "git push"}, "", 1, 0},
+		{"exit status", failing, false, false, nil, "exit status 3: failed", 0, 0},
+		{"exit status skipped", failing, false, true, []string{"make", "git push"}, "", 1, 1},
+		{"persistent", "cat", true, false, []string{"make", "echo secret", "fail now", "git push"}, "", 0, 0},
+		{"persistent exiting", "head -c 5", true, false, nil, "Transform command stopped", 0, 0},
+		// tr buffers its output written to a pipe, it never answers the first command
+		{"persistent buffered", "tr a-z A-Z", true, false, nil, "didn't answer within", 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, dsn := openTestDB(t)
+			cfg := testConfig(dsn)
+			cfg.TransformCommand = test.program
+			cfg.TransformPersistent = test.persistent
+			cfg.TransformTimeout = 200 * time.Millisecond
+			cfg.SkipErrors = test.skipErrors
+			addHistories(t, &cfg, history)
+			stats, err := Import(context.Background(), cfg)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := commandsOf(queryHistory(t, db)); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("commands = %q, want %q", got, test.want)
+			}
+			if stats.Ignored != int64(test.ignored) || stats.ParseErrors != int64(test.parseErrors) {
+				t.Errorf("ignored=%d parse_errors=%d, want %d and %d", stats.Ignored, stats.ParseErrors, test.ignored, test.parseErrors)
+			}
+		})
+	}
+}
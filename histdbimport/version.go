@@ -0,0 +1,28 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package histdbimport
+
+import "runtime/debug"
+
+// Version of histdbimport recorded with import runs, set at build time with
+// -ldflags "-X github.com/drewis/go-histdbimport/histdbimport.Version=v1.2.3".
+// The module version is used if empty, as set by go install
+var Version string
+
+func toolVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == "github.com/drewis/go-histdbimport" {
+				return dep.Version
+			}
+		}
+		if info.Main.Path == "github.com/drewis/go-histdbimport" {
+			return info.Main.Version
+		}
+	}
+	return "unknown"
+}
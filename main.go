@@ -5,55 +5,91 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"database/sql"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
-	"golang.org/x/text/encoding/unicode"
-	"golang.org/x/text/transform"
+	"github.com/drewis/go-histdbimport/histdbimport"
 )
 
-// used for dir column
-var unknownDir string
+// import settings populated from flags
+var cfg histdbimport.Config
 
-// used for host column
-var hostName string
+// commands to ignore, comma separated
+var boringCommands = strings.Join(histdbimport.DefaultIgnore, ",")
 
-// used for session column
-var sessionNum = "0"
+// patterns of commands to ignore, comma separated
+var boringPatterns string
 
-// used for exit_status column
-var retVal = "0"
+// globs of commands to ignore, comma separated
+var boringGlobs string
 
-// representation of a history entry
-type basicEntry struct {
-	started  string //no reason to convert to uint64
-	duration string
-	cmd      string
-}
+// commands and patterns to import exclusively
+var onlyCommands, onlyPatterns string
+
+// name of log level
+var logLevel string
+
+// IANA name of the timezone start times are interpreted in
+var timezone string
+
+// location of zsh history file to export the database to
+var exportFile string
+
+// bounds of the imported time range, dates or durations before now
+var since, until string
+
+// time of the import, epoch seconds or a date
+var baseTime string
+
+// location of the rules file
+var rulesFile string
+
+// file holding the SQLCipher key, kept out of the process list unlike -key
+var keyFile string
+
+// create the directory of the database if missing
+var mkdir bool
+
+// report what would be imported instead of importing
+var summarize bool
+
+// location of the JSON report of the run, - for stdout
+var reportJSON string
 
-var boringCommands = strings.Join([]string{
-	"cd",
-	"ls",
-	"top",
-	"htop",
-}, ",")
+// import history files again even if their checksum was recorded
+var force bool
 
-// location of database file
-var databaseFile string
+// value for session column, or auto
+var session string
 
-// location of history file
-var historyFile string
+// host names and directory prefixes to rewrite, comma separated from=to pairs
+var hostMap, dirMap string
+
+// directory of history files to import, the glob their names must match, and whether their names set the host column
+var historyDir, historyGlob string
+var hostFromName bool
+
+// keep importing entries appended to the history files, checking them every followInterval
+var follow bool
+var followInterval time.Duration
+
+// entries above which to ask before importing, and whether to answer yes
+var confirmAbove int64
+var assumeYes bool
 
 func init() {
 	host, err := os.Hostname()
@@ -66,11 +102,101 @@ func init() {
 	}
 
 	dbPath, historyPath := getFilePath(home)
-	flag.StringVar(&databaseFile, "database", dbPath, "location of database file")
-	flag.StringVar(&historyFile, "history", historyPath, "location of history file")
+	flag.StringVar(&cfg.DatabaseFile, "database", dbPath, "location of database file")
+	flag.StringVar(&cfg.DatabaseURL, "database-url", "", "SQLite DSN passed verbatim to the driver instead of -database (e.g. file:history.db?_journal_mode=WAL)")
+	flag.StringVar(&cfg.Key, "key", "", "SQLCipher key of an encrypted database, requires a build against SQLCipher")
+	flag.StringVar(&keyFile, "keyfile", "", "file holding the SQLCipher key of an encrypted database, instead of -key")
+	flag.StringVar(&cfg.HistoryFile, "history", historyPath, "comma separated locations of history files, - to read from stdin, file:host sets the host column for a file")
+	flag.BoolVar(&mkdir, "mkdir", false, "create the directory of the database file if it doesn't exist")
+	flag.StringVar(&historyDir, "history-dir", "", "import every history file under this directory instead of -history, unless -history is also set")
+	flag.StringVar(&historyGlob, "glob", "*", "only import the files of -history-dir whose name matches this glob (e.g. *.zsh_history)")
+	flag.BoolVar(&hostFromName, "host-from-filename", false, "set the host column of the files of -history-dir to their name without extension")
+	flag.StringVar(&exportFile, "export", "", "export database to this zsh history file instead of importing, - for stdout")
+	flag.StringVar(&cfg.RecordSep, "record-sep", "newline", "separator between history entries (newline, nul for NUL terminated records)")
+	flag.StringVar(&cfg.Format, "format", "auto", "format of history file (auto detecting zsh, bash or fish from the first lines, untimed files being read as zsh, zsh, zsh-dir, zsh-host, bash, bash-plain, fish, psreadline, json, plain, histdb-tsv)")
+	flag.StringVar(&cfg.FieldSep, "field-sep", ";", "separator between the timestamp data and the command of zsh entries")
+	flag.StringVar(&cfg.MetaSep, "meta-sep", ":", "separator within the timestamp data of zsh entries")
+	flag.IntVar(&cfg.Parsers, "parsers", 1, "goroutines parsing entries ahead of the inserts, entries are parsed while inserting if 1")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 500, "number of entries inserted per statement, 1 to insert entries one by one")
+	flag.StringVar(&cfg.TimeFormat, "time-format", "", "Go time layout of start times that aren't epoch seconds, relative for times like 5m ago, 2 hours ago or yesterday")
+	flag.StringVar(&cfg.TimeUnit, "time-unit", "s", "unit of the stored start_time (s, ms)")
+	flag.StringVar(&timezone, "timezone", "", "IANA timezone start times in -time-format are interpreted in (default local)")
+	flag.StringVar(&session, "session", "0", "value for session column to tell this import apart, auto uses one more than the largest session in the database")
+	flag.DurationVar(&cfg.SessionGap, "session-gap", 0, "start a new session when consecutive entries are further apart (e.g. 30m), 0 keeps every entry in -session")
+	flag.StringVar(&since, "since", "", "only import entries started after this date (2006-01-02, RFC3339) or duration ago (e.g. 36h, 7d)")
+	flag.StringVar(&until, "until", "", "only import entries started before this date (2006-01-02, RFC3339) or duration ago (e.g. 36h, 7d)")
+	flag.StringVar(&baseTime, "base-time", "", "time of the import used for entries without timestamp, epoch seconds or a date (2006-01-02, RFC3339), for reproducible imports (default now)")
+	flag.BoolVar(&cfg.PreserveOrder, "preserve-order", false, "give entries without timestamp increasing timestamps ending at the import time, at the cost of reading the histfile twice (default from PRESERVE_ORDER)")
+	flag.BoolVar(&cfg.ExcludeUntimed, "exclude-untimed", false, "skip entries without timestamp when -since or -until is set")
+	flag.Int64Var(&cfg.Limit, "limit", 0, "only import the first N entries of each history file, 0 imports all")
+	flag.Float64Var(&cfg.Sample, "sample", 0, "probability (0-1) of importing each entry, to try an import on a random sample, 0 imports all")
+	flag.Int64Var(&cfg.SampleSeed, "sample-seed", 0, "seed of -sample to import the same sample again (default random)")
+	flag.Int64Var(&cfg.Tail, "tail", 0, "only import the last N entries of each history file, 0 imports all")
+	flag.IntVar(&cfg.MaxCommandLength, "max-command-length", 0, "longest command imported in characters, e.g. to leave out pasted blobs, unlimited if 0")
+	flag.IntVar(&cfg.MinCommandLength, "min-command-length", 0, "ignore commands shorter than this many characters, e.g. 3 to leave out l, ll or c, unlimited if 0")
+	flag.DurationVar(&cfg.MaxSkew, "max-skew", time.Hour, "how far in the future start times may be before entries are handled by -on-future, unchecked if 0")
+	flag.StringVar(&cfg.OnFuture, "on-future", "keep", "what to do with entries starting later than -max-skew from now (keep with a warning, skip, clamp to now, fail)")
+	flag.StringVar(&cfg.OnOversize, "on-oversize", "truncate", "what to do with commands longer than -max-command-length (truncate, skip)")
+	flag.StringVar(&cfg.OnInvalidBytes, "on-invalid-bytes", "keep", "what to do with commands containing NUL or control bytes other than newline and tab (keep, strip, skip, fail)")
+	flag.StringVar(&cfg.Encoding, "encoding", "utf-8", "encoding of the history file (utf-8 replacing invalid bytes, utf-8-lenient decoding them as latin1, latin1)")
+	flag.StringVar(&cfg.Multiline, "multiline", "preserve", "how newlines of multi-line commands are stored (preserve, collapse to spaces, escape as \\n)")
+	flag.BoolVar(&cfg.ComputeDuration, "compute-duration", false, "set missing or zero durations to the time elapsed since the entry started, like histdb does")
+	flag.BoolVar(&follow, "follow", false, "after the import, keep importing entries appended to the history files like tail -f until interrupted")
+	flag.DurationVar(&followInterval, "follow-interval", 2*time.Second, "how often -follow checks the history files for new entries")
+	flag.StringVar(&reportJSON, "report-json", "", "write a JSON report of the run (counts, time range, files, duration) to this file, - for stdout")
+	flag.BoolVar(&summarize, "summarize", false, "report distinct commands, hosts, dirs and the time span of the entries that would be imported, then exit")
+	flag.Int64Var(&confirmAbove, "confirm", 10000, "ask before importing more than N entries, only when stdin is a terminal unless set explicitly")
+	flag.BoolVar(&assumeYes, "yes", false, "import without asking for confirmation, for scripts")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "parse history file and log entries without writing to database")
+	flag.StringVar(&logLevel, "log-level", "info", "log level (debug logs every entry, info, error)")
+	flag.StringVar(&cfg.JournalMode, "journal-mode", "", "SQLite journal mode (delete, truncate, persist, memory, wal, off), unchanged if empty")
+	flag.StringVar(&cfg.Synchronous, "synchronous", "", "SQLite synchronous mode (off, normal, full, extra), unchanged if empty")
+	flag.IntVar(&cfg.CacheSize, "cache-size", 0, "SQLite cache size in pages, or KiB if negative, unchanged if 0")
+	flag.DurationVar(&cfg.BusyTimeout, "busy-timeout", 5*time.Second, "how long to wait for another process (e.g. the histdb hook) to unlock the database")
+	flag.BoolVar(&cfg.RecordRuns, "record-runs", false, "record each import in a histdbimport_runs table: when it ran, the history files, host, entries inserted and version")
+	flag.StringVar(&cfg.Tag, "tag", "", "label recorded with the import in histdbimport_runs, implies -record-runs")
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a pprof CPU profile of the import to this file")
+	flag.StringVar(&memProfile, "memprofile", "", "write a pprof heap profile taken after the import to this file")
+	flag.BoolVar(&cfg.PrintSQL, "print-sql", false, "log the SQL run by the import with its arguments")
+	flag.BoolVar(&cfg.RedactSQL, "redact", false, "mask commands in the SQL logged by -print-sql, to share logs")
+	flag.BoolVar(&cfg.Progress, "progress", false, "log progress periodically instead of every entry")
+	flag.DurationVar(&cfg.StatsEvery, "stats-every", 0, "log entries per second and the estimated remaining time every interval (e.g. 10s), with -preserve-order or -tail for the estimate")
+	flag.StringVar(&cfg.TemplateDatabase, "template-db", "", "database whose schema (tables, indexes, views) is copied into -database when it is new or empty, e.g. one created by histdb")
+	flag.BoolVar(&cfg.CreateSchema, "create-schema", false, "create histdb tables if database has none of them, and the raw column of history for -store-raw")
+	flag.StringVar(&cfg.CommandsTable, "commands-table", "commands", "name of the histdb commands table")
+	flag.StringVar(&cfg.PlacesTable, "places-table", "places", "name of the histdb places table")
+	flag.StringVar(&cfg.HistoryTable, "history-table", "history", "name of the histdb history table")
+	flag.BoolVar(&cfg.StoreRaw, "store-raw", false, "store each entry as read from the histfile in a raw column of history, to audit how it was parsed")
+	flag.IntVar(&cfg.Verify, "verify", 0, "after the import, check that the last N inserted rows match the entries they were inserted from")
+	flag.BoolVar(&cfg.CreateIndexes, "create-indexes", false, "create the indexes histdb queries rely on if missing, only warn about them otherwise")
+	flag.Int64Var(&cfg.CommitEvery, "commit-every", 0, "commit every N inserted entries so a failure only loses the last ones, 0 imports in a single transaction")
+	flag.BoolVar(&cfg.KeepPartial, "keep-partial", false, "commit the entries inserted before an error instead of rolling back, re-run with -skip-existing to finish")
+	flag.BoolVar(&force, "force", false, "import history files even if a file with the same checksum was already imported")
+	flag.BoolVar(&cfg.Resume, "resume", false, "skip the entries read by a previous import using -commit-every or -resume")
+	flag.BoolVar(&cfg.Strict, "strict", false, "fail on start times, durations or exit statuses that aren't integers and negative durations instead of replacing them")
+	flag.BoolVar(&cfg.SkipErrors, "skip-errors", false, "skip entries that fail to parse instead of aborting")
+	flag.BoolVar(&cfg.DedupHistory, "dedup-history", false, "create a unique index over the session, command, place and start time of history and ignore rows already present, making imports idempotent")
+	flag.BoolVar(&cfg.NoTransaction, "no-transaction", false, "insert entries without transaction, each statement commits on its own: much slower, but the db isn't locked during the whole import and a failure keeps the entries inserted before it")
+	flag.BoolVar(&cfg.Stage, "stage", false, "insert entries into a temporary table and merge them into history with a single statement before committing, -skip-existing is then checked by the merge")
+	flag.BoolVar(&cfg.SkipExisting, "skip-existing", false, "skip entries already present in database, allows re-running an import")
 	flag.StringVar(&boringCommands, "ignore", boringCommands, "commands to ignore during import")
-	flag.StringVar(&hostName, "host", host, "value for host column")
-	flag.StringVar(&unknownDir, "dir", home, "directory used for command import")
+	flag.BoolVar(&cfg.SkipEmpty, "skip-empty", true, "ignore entries whose command is empty or only whitespace")
+	flag.BoolVar(&cfg.IgnoreCase, "ignore-case", false, "match -ignore commands case-insensitively")
+	flag.StringVar(&boringPatterns, "ignore-regex", "", "comma separated regular expressions of commands to ignore during import")
+	flag.StringVar(&boringGlobs, "ignore-glob", "", "comma separated shell globs of commands to ignore during import, * also matches /")
+	flag.StringVar(&onlyCommands, "only", "", "comma separated commands to import exclusively, -ignore still applies")
+	flag.StringVar(&onlyPatterns, "only-regex", "", "comma separated regular expressions of commands to import exclusively (e.g. ^ssh ,^docker ), -ignore still applies")
+	flag.StringVar(&cfg.TransformCommand, "transform-cmd", "", "program each command is piped to (run with sh -c), its output replaces the command, e.g. to redact secrets")
+	flag.BoolVar(&cfg.TransformPersistent, "transform-persistent", false, "keep one -transform-cmd process per history file exchanging NUL terminated commands on stdin and stdout, instead of one per entry")
+	flag.DurationVar(&cfg.TransformTimeout, "transform-timeout", 10*time.Second, "how long the -transform-persistent process may take to answer each command, it must not buffer its output")
+	flag.StringVar(&rulesFile, "rules", "", "file of \"<regexp> -> skip\" or \"<regexp> -> <exit status>\" lines applied to commands, the first matching rule applies")
+	flag.BoolVar(&cfg.DedupConsecutive, "dedup-consecutive", false, "collapse runs of the same command in the same place into one entry with the time of the last")
+	flag.BoolVar(&cfg.DedupWithinFile, "dedup-within-file", false, "skip entries whose start time, command, host and dir repeat an earlier entry of the same history file, e.g. in merged histfiles")
+	flag.StringVar(&cfg.Host, "host", host, "value for host column")
+	flag.StringVar(&cfg.HostSuffix, "host-suffix", "", "appended to the host of every entry after -host-map, e.g. to tell apart machines sharing a hostname")
+	flag.StringVar(&hostMap, "host-map", "", "comma separated from=to pairs rewriting host names on import (e.g. laptop.local=laptop)")
+	flag.StringVar(&cfg.Dir, "dir", home, "directory used for command import when the format doesn't record it")
+	flag.StringVar(&dirMap, "dir-map", "", "comma separated prefix=replacement pairs rewriting directories on import, the longest matching prefix applies (e.g. /Users/alice=/home/alice)")
 }
 
 func getFilePath(home string) (dbPath string, historyPath string) {
@@ -91,299 +217,422 @@ func getFilePath(home string) (dbPath string, historyPath string) {
 	return
 }
 
-// Reads the entry, traversing multiple lines if needed
-func readEntry(s *bufio.Scanner, buf *bytes.Buffer) (string, bool, error) {
-	var ok bool
-	entry := ""
-	for {
-		ok = s.Scan()
-		if !ok {
-			break
-		}
+// Checks that the directory of the database file exists and is writable, creating it if mkdir is set,
+// so path errors surface before the history is read
+func checkDatabasePath(path string, mkdir bool) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err) && mkdir:
+		return os.MkdirAll(dir, 0700)
+	case os.IsNotExist(err):
+		return errors.New("Database directory doesn't exist=" + dir + ", create it or use -mkdir")
+	case err != nil:
+		return err
+	case !info.IsDir():
+		return errors.New("Database directory isn't a directory=" + dir)
+	}
 
-		if buf != nil {
-			// write line back to buf to recreate scanner later
-			_, err := fmt.Fprintln(buf, s.Text())
-			if err != nil {
-				return "", false, err
-			}
-		}
+	// SQLite writes its journal next to the database, so the directory must be writable as well
+	fd, err := ioutil.TempFile(dir, ".histdbimport")
+	if err != nil {
+		return errors.New("Database directory isn't writable=" + dir)
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
 
-		entry += s.Text()
-		entryLen := len(entry)
-		if entryLen == 0 {
-			break
-		}
-		//multiline cmds end with slash
-		if entry[entryLen-1] == '\\' {
-			//trim the slash and restore the new line
-			entry = entry[:entryLen-1] + "\n"
-			continue
+// Exports the database to a new zsh history file, existing files are never overwritten
+func export(ctx context.Context, path string) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
 		}
-		break
+		defer fd.Close()
+		w = fd
 	}
-	return entry, ok, nil
-}
 
-// Parses an entry string into a basicEntry
-func parseEntry(entry string, timestamp int64) (basicEntry, error) {
-	var (
-		data      []string
-		entryInfo basicEntry
-	)
+	count, err := histdbimport.Export(ctx, cfg, w)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d entries\n", count)
+	return nil
+}
 
-	// if entry have timestamp data
-	if strings.HasPrefix(entry, ": ") {
-		data = strings.SplitN(entry, ";", 2)
-		if data == nil {
-			return basicEntry{}, errors.New("Unable to parse entry= " + entry)
+// Parses a date in the local timezone, an RFC3339 time, or a duration before now with an optional d suffix for days
+func parseTimeBound(value string, now time.Time) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
 		}
 	}
 
-	if len(data) == 2 {
-		// processing histfile with timestamp
-		info := strings.Split(data[0], ":")
-		if info == nil || len(info) != 3 {
-			return basicEntry{}, errors.New("Unable to parse timestamp=" + data[0])
+	if strings.HasSuffix(value, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil {
+			return now.AddDate(0, 0, -days), nil
 		}
-
-		entryInfo.started = strings.TrimSpace(info[1])
-		entryInfo.duration = strings.TrimSpace(info[2])
-		entryInfo.cmd = data[1]
-	} else {
-		// processing histfile without timestamp
-		entryInfo.started = fmt.Sprintf("%d", timestamp)
-		entryInfo.duration = "0"
-		entryInfo.cmd = entry
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
 	}
 
-	return entryInfo, nil
-}
-
-type transaction struct {
-	*sql.Tx
-	cmdStmt   *sql.Stmt
-	placeStmt *sql.Stmt
-	histStmt  *sql.Stmt
+	return time.Time{}, errors.New("Invalid date or duration=" + value)
 }
 
-func beginTransaction(db *sql.DB) (txx *transaction, err error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, err
-	}
-	t := &transaction{Tx: tx}
-	defer func() {
-		if err != nil {
-			if t.cmdStmt != nil {
-				t.cmdStmt.Close()
-			}
-			if t.placeStmt != nil {
-				t.placeStmt.Close()
-			}
-			if t.histStmt != nil {
-				t.histStmt.Close()
+// Parses a comma separated list of history files, each optionally suffixed with :host
+func parseHistorySources(list string) (sources []histdbimport.HistorySource) {
+	for _, file := range strings.Split(list, ",") {
+		// the colons of a remote URL's scheme and port come before its path
+		start := 0
+		if histdbimport.IsRemote(file) {
+			start = len(file)
+			if i := strings.Index(file[len("ssh://"):], "/"); i >= 0 {
+				start = len("ssh://") + i
 			}
-			t.Rollback()
 		}
-	}()
-
-	/*
-	   insert into commands (argv) values (${cmd});
-	   insert into places   (host, dir) values (${HISTDB_HOST}, ${pwd});
-	   insert into history
-	     (session, command_id, place_id, exit_status, start_time, duration)
-	   select
-	     ${HISTDB_SESSION},
-	     commands.rowid,
-	     places.rowid,
-	     ${retval},
-	     ${started},
-	     ${now} - ${started}
-	   from
-	     commands, places
-	   where
-	     commands.argv = ${cmd} and
-	     places.host = ${HISTDB_HOST} and
-	     places.dir = ${pwd}
-	   ;
-	*/
-	t.cmdStmt, err = t.Prepare("INSERT INTO commands (argv) VALUES (?);")
-	if err != nil {
-		return nil, err
-	}
-	t.placeStmt, err = t.Prepare("INSERT INTO places (host, dir) VALUES (?, ?);")
-	if err != nil {
-		return nil, err
-	}
-	t.histStmt, err = t.Prepare(`
-		INSERT INTO history (session, command_id, place_id, exit_status, start_time, duration)
-			SELECT ?, commands.rowid, places.rowid, ?, ?, ?
-			FROM commands, places
-			WHERE commands.argv = ? AND places.host = ? AND places.dir = ?;
-	`)
-	if err != nil {
-		return nil, err
+		var host string
+		if i := strings.LastIndex(file[start:], ":"); i >= 0 {
+			file, host = file[:start+i], file[start+i+1:]
+		}
+		sources = append(sources, histdbimport.HistorySource{File: file, Host: host})
 	}
-
-	return t, nil
+	return
 }
 
-func (t *transaction) insertEntry(entry basicEntry) (err error) {
-	_, err = t.cmdStmt.Exec(entry.cmd)
-	if err != nil {
-		return err
-	}
-	_, err = t.placeStmt.Exec(hostName, unknownDir)
-	if err != nil {
-		return err
-	}
-	_, err = t.histStmt.Exec(sessionNum, retVal, entry.started, entry.duration, entry.cmd, hostName, unknownDir)
-	if err != nil {
-		return err
+// Parses comma separated from=to pairs of the named flag
+func parsePairs(name, list string) (map[string]string, error) {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, errors.New("Invalid -" + name + " pair=" + pair)
+		}
+		pairs[pair[:i]] = pair[i+1:]
 	}
-
-	return nil
+	return pairs, nil
 }
 
 func main() {
 	flag.Parse()
 
-	db, err := sql.Open("sqlite3", databaseFile)
+	level, err := histdbimport.ParseLogLevel(logLevel)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	cfg.LogLevel = level
 
-	tx, err := beginTransaction(db)
-	if err != nil {
-		log.Fatal(err)
+	if timezone != "" {
+		cfg.Location, err = time.LoadLocation(timezone)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	fd, err := os.Open(historyFile)
-	if err != nil {
-		log.Fatal(err)
+	now := time.Now()
+	if since != "" {
+		cfg.Since, err = parseTimeBound(since, now)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	defer fd.Close()
-
-	var preserveOrder bool
-	if strPreserveOrder := os.Getenv("PRESERVE_ORDER"); strPreserveOrder != "" {
-		preserveOrder, err = strconv.ParseBool(strPreserveOrder)
+	if until != "" {
+		cfg.Until, err = parseTimeBound(until, now)
 		if err != nil {
-			log.Fatal("Invalid PRESERVE_ORDER value")
+			log.Fatal(err)
 		}
 	}
 
-	err = readAndInsert(tx, fd, preserveOrder)
-	if err != nil {
-		tx.Rollback()
-		log.Fatal(err)
+	if baseTime != "" {
+		if epoch, err := strconv.ParseInt(baseTime, 10, 64); err == nil {
+			cfg.BaseTime = time.Unix(epoch, 0)
+		} else {
+			cfg.BaseTime, err = parseTimeBound(baseTime, now)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+	// -preserve-order takes precedence over the environment, -database conflicts with -database-url,
+	// -history-dir replaces the default -history
+	preserveOrderSet, databaseSet, historySet, confirmSet := false, false, false, false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "confirm":
+			confirmSet = true
+		case "preserve-order":
+			preserveOrderSet = true
+		case "database":
+			databaseSet = true
+		case "history":
+			historySet = true
+		}
+	})
 
-func readAndInsert(tx *transaction, r io.Reader, preserveOrder bool) (err error) {
-	// use currentTimestamp as timestamp for commands if histfile doesn't contain timestamp
-	currentTimestamp := time.Now().Unix()
+	if historyDir == "" || historySet {
+		cfg.HistoryFiles = parseHistorySources(cfg.HistoryFile)
+	}
+	cfg.HistoryFile = ""
+	if historyDir != "" {
+		sources, err := histdbimport.DirSources(historyDir, historyGlob, hostFromName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(sources) == 0 {
+			log.Fatalf("No history file matching %s in %s", historyGlob, historyDir)
+		}
+		cfg.HistoryFiles = append(cfg.HistoryFiles, sources...)
+	}
 
-	r = transform.NewReader(r, unicode.UTF8.NewDecoder())
-	scanner := bufio.NewScanner(r)
+	cfg.SkipImported = !force
 
-	bcs := strings.Split(boringCommands, ",")
+	if session == "auto" {
+		cfg.AutoSession = true
+	} else if cfg.Session, err = strconv.ParseInt(session, 10, 64); err != nil {
+		log.Fatal("Invalid -session value=" + session)
+	}
 
-	// if preserving order, rewind currentTimestamp based on total inserted entry into db
-	if preserveOrder {
-		currentTimestamp, err = rewindTimestamp(scanner, bcs, currentTimestamp)
+	if hostMap != "" {
+		cfg.HostMap, err = parsePairs("host-map", hostMap)
 		if err != nil {
-			return err
+			log.Fatal(err)
 		}
 	}
-
-outer:
-	for {
-		if err = scanner.Err(); err != nil {
-			return err
+	if dirMap != "" {
+		cfg.DirMap, err = parsePairs("dir-map", dirMap)
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		entry, ok, err := readEntry(scanner, nil)
-		switch {
-		case err != nil:
-			return err
-		case !ok:
-			break outer
-		case entry == "":
-			continue outer
+	cfg.Ignore = strings.Split(boringCommands, ",")
+	if boringPatterns != "" {
+		for _, pattern := range strings.Split(boringPatterns, ",") {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("Invalid -ignore-regex pattern=%s: %v", pattern, err)
+			}
+			cfg.IgnoreRegex = append(cfg.IgnoreRegex, re)
 		}
-
-		parsed, err := parseEntry(entry, currentTimestamp)
-		if err != nil {
-			return err
+	}
+	if boringGlobs != "" {
+		for _, glob := range strings.Split(boringGlobs, ",") {
+			re, err := histdbimport.CompileGlob(glob)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.IgnoreRegex = append(cfg.IgnoreRegex, re)
 		}
+	}
 
-		for _, bc := range bcs {
-			if parsed.cmd == bc {
-				log.Printf("Skipping %+v\n", parsed)
-				continue outer
+	if onlyCommands != "" {
+		cfg.Only = strings.Split(onlyCommands, ",")
+	}
+	if onlyPatterns != "" {
+		for _, pattern := range strings.Split(onlyPatterns, ",") {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				log.Fatalf("Invalid -only-regex pattern=%s: %v", pattern, err)
 			}
+			cfg.OnlyRegex = append(cfg.OnlyRegex, re)
 		}
+	}
 
-		log.Printf("Inserting %+v\n", parsed)
-		err = tx.insertEntry(parsed)
+	if rulesFile != "" {
+		fd, err := os.Open(rulesFile)
 		if err != nil {
-			return err
+			log.Fatal(err)
+		}
+		cfg.Rules, err = histdbimport.ParseRules(fd)
+		fd.Close()
+		if err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		// fast-forward current timestamp if preserving order
-		if preserveOrder {
-			currentTimestamp++
+	if keyFile != "" {
+		if cfg.Key != "" {
+			log.Fatal("Only one of -key and -keyfile can be set")
+		}
+		key, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.Key = strings.TrimRight(string(key), "\r\n")
+		if cfg.Key == "" {
+			log.Fatal("Empty key in -keyfile " + keyFile)
 		}
 	}
 
-	return nil
-}
+	if cfg.DatabaseURL != "" {
+		if databaseSet {
+			log.Fatal("Only one of -database and -database-url can be set")
+		}
+		cfg.DatabaseFile = ""
+	}
+	if strPreserveOrder := os.Getenv("PRESERVE_ORDER"); strPreserveOrder != "" && !preserveOrderSet {
+		preserveOrder, err := strconv.ParseBool(strPreserveOrder)
+		if err != nil {
+			log.Fatal("Invalid PRESERVE_ORDER value")
+		}
+		cfg.PreserveOrder = preserveOrder
+	}
 
-func rewindTimestamp(scanner *bufio.Scanner, bcs []string, currentTimestamp int64) (int64, error) {
-	var (
-		lineCount int64
-		buf       bytes.Buffer
-	)
+	// cancel on interrupt, Import rolls back the transaction before returning
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, aborting\n", sig)
+		cancel()
+	}()
 
-	// replicate loop of readAndInsert() to count total entry need to be inserted
-outer:
-	for {
-		if err := scanner.Err(); err != nil {
-			return 0, err
+	if exportFile != "" {
+		err = export(ctx, exportFile)
+		if err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		entry, ok, err := readEntry(scanner, &buf)
-		switch {
-		case err != nil:
-			return 0, err
-		case !ok:
-			break outer
-		case entry == "":
-			continue outer
+	if summarize {
+		summary, err := histdbimport.Summarize(ctx, cfg)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("Summary: %s\n", summary)
+		return
+	}
 
-		parsed, err := parseEntry(entry, currentTimestamp)
+	// DSNs may be URIs or hold parameters, they are left to the driver
+	if !cfg.DryRun && cfg.DatabaseURL == "" {
+		err = checkDatabasePath(cfg.DatabaseFile, mkdir)
 		if err != nil {
-			return 0, err
+			log.Fatal(err)
 		}
+	}
+
+	if follow {
+		for _, src := range cfg.HistoryFiles {
+			if src.File == "-" {
+				log.Fatal("-follow can't be used with history read from stdin")
+			}
+			if histdbimport.IsRemote(src.File) {
+				log.Fatal("-follow can't be used with remote history " + src.File)
+			}
+		}
+	}
 
-		for _, bc := range bcs {
-			if parsed.cmd == bc {
-				continue outer
+	if !cfg.DryRun && !assumeYes && (confirmSet || isTerminal(os.Stdin)) {
+		for _, src := range cfg.HistoryFiles {
+			if src.File == "-" {
+				log.Fatal("Unable to ask for confirmation while reading history from stdin, use -yes")
 			}
 		}
+		cfg.Confirm = func(file string, entries int64) (bool, error) {
+			return confirmImport(ctx, file, entries)
+		}
+	}
+
+	stopProfiles, err := startProfiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	start := time.Now()
+	stats, err := histdbimport.Import(ctx, cfg)
+	stopProfiles()
+	if reportJSON != "" {
+		if reportErr := writeReport(reportJSON, stats, start, err); reportErr != nil {
+			log.Print(reportErr)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if follow {
+		err = histdbimport.Follow(ctx, cfg, followInterval, stats.Offsets)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Asks on stdin whether to import the entries of file when there are more than -confirm, an interrupt cancels the import
+func confirmImport(ctx context.Context, file string, entries int64) (bool, error) {
+	if entries <= confirmAbove {
+		return true, nil
+	}
 
-		lineCount++
+	db := cfg.DatabaseFile
+	if cfg.DatabaseURL != "" {
+		db = cfg.DatabaseURL
 	}
+	fmt.Fprintf(os.Stderr, "About to import %d entries of %s into %s. Continue? [y/N] ", entries, file, db)
+
+	// the read can't be interrupted, it's left blocked when canceled as the process exits
+	type result struct {
+		answer string
+		err    error
+	}
+	answered := make(chan result, 1)
+	go func() {
+		answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		answered <- result{answer, err}
+	}()
+	var res result
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(os.Stderr)
+		return false, ctx.Err()
+	case res = <-answered:
+	}
+	if res.err != nil && res.err != io.EOF {
+		return false, res.err
+	}
+	answer := strings.ToLower(strings.TrimSpace(res.answer))
+	return answer == "y" || answer == "yes", nil
+}
+
+// report of a run written by -report-json
+type runReport struct {
+	Files []string `json:"files"`
+	histdbimport.Stats
+	DryRun  bool      `json:"dry_run"`
+	Started time.Time `json:"started"`
+	Seconds float64   `json:"duration_seconds"`
+	// error aborting the import, nothing was inserted unless -commit-every or -keep-partial was set
+	Error string `json:"error,omitempty"`
+}
 
-	// recreate scanner after read
-	*scanner = *bufio.NewScanner(&buf)
-	return currentTimestamp - lineCount, nil
+// Writes the JSON report of an import started at start, which ended with err
+func writeReport(path string, stats histdbimport.Stats, start time.Time, err error) error {
+	report := runReport{
+		Stats:   stats,
+		DryRun:  cfg.DryRun,
+		Started: start,
+		Seconds: time.Since(start).Seconds(),
+	}
+	for _, src := range cfg.HistoryFiles {
+		report.Files = append(report.Files, src.File)
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
 }
@@ -0,0 +1,59 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// locations of the pprof CPU and heap profiles of the import
+var cpuProfile, memProfile string
+
+// Starts the CPU profile of -cpuprofile, the returned function stops it and writes the heap profile of -memprofile.
+// Files are created before the import so a bad path fails early
+func startProfiles() (stop func(), err error) {
+	var cpu, mem *os.File
+	if cpuProfile != "" {
+		cpu, err = os.Create(cpuProfile)
+		if err != nil {
+			return nil, err
+		}
+		if err = pprof.StartCPUProfile(cpu); err != nil {
+			cpu.Close()
+			return nil, err
+		}
+	}
+	if memProfile != "" {
+		mem, err = os.Create(memProfile)
+		if err != nil {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				cpu.Close()
+			}
+			return nil, err
+		}
+	}
+
+	return func() {
+		if cpu != nil {
+			pprof.StopCPUProfile()
+			if err := cpu.Close(); err != nil {
+				log.Print(err)
+			}
+		}
+		if mem != nil {
+			// up to date statistics of what is still allocated
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(mem); err != nil {
+				log.Print(err)
+			}
+			if err := mem.Close(); err != nil {
+				log.Print(err)
+			}
+		}
+	}, nil
+}